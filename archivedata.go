@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+const (
+	ArchiveDayFormat = "2006-01-02"
+)
+
+// Number of messages on a single day, straight from the database
+type ArchiveDayCount struct {
+	Day   string `db:"day"`
+	Count int64  `db:"count"`
+}
+
+// A single cell in the archive calendar. Day is 0 for padding cells
+type ArchiveCalendarDay struct {
+	Day   int
+	Date  string
+	Count int64
+}
+
+type ArchiveMonth struct {
+	Month time.Month
+	Count int64
+	Days  []ArchiveCalendarDay // Padded at the start so the first day lands on the right weekday
+
+	padding int
+}
+
+type ArchiveYear struct {
+	Year   int
+	Count  int64
+	Months []*ArchiveMonth
+}
+
+// Build the year -> month -> day calendar from the list of days with messages.
+// Only years and months with messages are included
+func MakeArchiveCalendar(counts []ArchiveDayCount) ([]*ArchiveYear, error) {
+	years := make([]*ArchiveYear, 0)
+	var year *ArchiveYear
+	var month *ArchiveMonth
+	for _, c := range counts {
+		day, err := time.Parse(ArchiveDayFormat, c.Day)
+		if err != nil {
+			return nil, err
+		}
+		if year == nil || year.Year != day.Year() {
+			year = &ArchiveYear{Year: day.Year(), Months: make([]*ArchiveMonth, 0)}
+			years = append(years, year)
+			month = nil
+		}
+		if month == nil || month.Month != day.Month() {
+			first := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+			last := first.AddDate(0, 1, -1)
+			month = &ArchiveMonth{Month: day.Month(), padding: int(first.Weekday())}
+			month.Days = make([]ArchiveCalendarDay, month.padding, month.padding+last.Day())
+			for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+				month.Days = append(month.Days, ArchiveCalendarDay{Day: d.Day(), Date: d.Format(ArchiveDayFormat)})
+			}
+			year.Months = append(year.Months, month)
+		}
+		month.Days[month.padding+day.Day()-1].Count = c.Count
+		month.Count += c.Count
+		year.Count += c.Count
+	}
+	return years, nil
+}
+
+// Create the base query for messages in the archive. The page should already
+// be checked for permissions, but we still do it here just in case
+func makeArchiveQuery(fields string, contentId int64, uid int64) contentapi.Query {
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT " + fields + " FROM messages m WHERE m.contentId = ?"
+	q.AddParams(contentId)
+	q.AndCommentViewable("m", uid, true)
+	q.AndViewable("m.contentId", uid)
+	return q
+}
+
+// Add the calendar of days with messages for the given page
+func (gctx *GonContext) AddArchiveData(hash string, user *UserSession, data map[string]any) error {
+	var uid int64
+	if user != nil {
+		uid = int64(user.Uid)
+	}
+
+	mainpage, err := gctx.GetViewablePage(hash, uid, false)
+	if err != nil {
+		return err
+	}
+
+	q := makeArchiveQuery("substr(m.createDate,1,10) AS day,COUNT(*) AS count", mainpage.Id, uid)
+	q.Sql += " GROUP BY day"
+	q.Order = "day"
+	q.Finalize()
+
+	counts := make([]ArchiveDayCount, 0)
+	err = gctx.contentdb.Select(&counts, q.Sql, q.Params...)
+	if err != nil {
+		return err
+	}
+
+	years, err := MakeArchiveCalendar(counts)
+	if err != nil {
+		return err
+	}
+
+	data["title"] = mainpage.Name + " (archive)"
+	data["mainpage"] = mainpage
+	data["years"] = years
+	data["resultcount"] = len(counts)
+
+	return nil
+}
+
+// Find the closest day with messages before (or after) the given day. Returns
+// empty if there isn't one
+func (gctx *GonContext) getArchiveNeighbor(contentId int64, uid int64, day time.Time, before bool) (string, error) {
+	var q contentapi.Query
+	if before {
+		q = makeArchiveQuery("MAX(substr(m.createDate,1,10))", contentId, uid)
+		q.AndTimeBefore("m.createDate", day.Format(ArchiveDayFormat))
+	} else {
+		q = makeArchiveQuery("MIN(substr(m.createDate,1,10))", contentId, uid)
+		q.AndTimeAtLeast("m.createDate", day.AddDate(0, 0, 1).Format(ArchiveDayFormat))
+	}
+	q.Finalize()
+
+	var result *string
+	err := gctx.contentdb.Get(&result, q.Sql, q.Params...)
+	if err != nil || result == nil {
+		return "", err
+	}
+	return *result, nil
+}
+
+// Add every message for a single day, along with the days around it
+func (gctx *GonContext) AddArchiveDayData(hash string, dayraw string, user *UserSession, data map[string]any) error {
+	var uid int64
+	if user != nil {
+		uid = int64(user.Uid)
+	}
+
+	day, err := time.Parse(ArchiveDayFormat, dayraw)
+	if err != nil {
+		return &utils.BadRequest{Message: fmt.Sprintf("Bad archive day %s, must be YYYY-MM-DD", dayraw)}
+	}
+
+	mainpage, err := gctx.GetViewablePage(hash, uid, false)
+	if err != nil {
+		return err
+	}
+
+	// Dates are stored as iso strings, so string comparisons work
+	q := makeArchiveQuery(contentapi.GetCommentFields("m"), mainpage.Id, uid)
+	q.AndTimeAtLeast("m.createDate", day.Format(ArchiveDayFormat))
+	q.AndTimeBefore("m.createDate", day.AddDate(0, 0, 1).Format(ArchiveDayFormat))
+	q.Order = "m.id"
+	q.Finalize()
+
+	comments := make([]contentapi.Comment, 0)
+	err = gctx.contentdb.Select(&comments, q.Sql, q.Params...)
+	if err != nil {
+		return err
+	}
+
+	_, err = gctx.ApplyCommentExtras(comments)
+	if err != nil {
+		return err
+	}
+
+	previous, err := gctx.getArchiveNeighbor(mainpage.Id, uid, day, true)
+	if err != nil {
+		return err
+	}
+	next, err := gctx.getArchiveNeighbor(mainpage.Id, uid, day, false)
+	if err != nil {
+		return err
+	}
+
+	data["title"] = fmt.Sprintf("%s (%s)", mainpage.Name, day.Format(ArchiveDayFormat))
+	data["mainpage"] = mainpage
+	data["day"] = day.Format(ArchiveDayFormat)
+	data["comments"] = comments
+	data["previousday"] = previous
+	data["nextday"] = next
+
+	return nil
+}
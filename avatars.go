@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+// Avatars are upload hashes, same as the routes allow
+var avatarRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// The url for someone's avatar. Takes anything with a user in it: users,
+// sessions, comments (which can have their own avatar) or just the id
+func AvatarUrl(config *Config, who any) string {
+	var uid int64
+	override := ""
+	switch v := who.(type) {
+	case int64:
+		uid = v
+	case int:
+		uid = int64(v)
+	case *contentapi.User:
+		if v != nil {
+			uid = v.Id
+		}
+	case contentapi.User:
+		uid = v.Id
+	case *UserSession:
+		if v != nil {
+			uid = v.Uid
+		}
+	case *contentapi.Comment:
+		if v != nil {
+			uid, override = v.CreateUserId, v.GetValue("a", "avatar")
+		}
+	case contentapi.Comment:
+		uid, override = v.CreateUserId, v.GetValue("a", "avatar")
+	}
+	result := fmt.Sprintf("%s/avatars/%d", config.RootPath, uid)
+	if override != "" {
+		result += "?avatar=" + url.QueryEscape(override)
+	}
+	return result
+}
+
+// The high-DPI versions of AvatarUrl
+func AvatarSrcset(config *Config, who any) string {
+	return imageSrcset(config, AvatarUrl(config, who))
+}
+
+// Serve a user's avatar as a square of one of the allowed sizes. A different
+// avatar than the user's can be given (messages can have their own). Users
+// without an avatar (or whose avatar is broken) get an identicon
+func (gctx *GonContext) ServeAvatar(w http.ResponseWriter, r *http.Request, uid int64) {
+	query := r.URL.Query()
+	defaults := gctx.ThumbnailOptions()
+	options, err := gctx.ParseImageOptions(url.Values{"size": query["size"]}, defaults)
+	if handleError(err, w) {
+		return
+	}
+	avatar := query.Get("avatar")
+	if avatar == "" {
+		err = gctx.contentdb.Get(&avatar, "SELECT avatar FROM users WHERE id = ?", uid)
+		if err != nil && err != sql.ErrNoRows {
+			handleError(err, w)
+			return
+		}
+	}
+	// contentapi used "0" for "no avatar"
+	if avatar != "" && avatar != "0" && avatarRegex.MatchString(avatar) {
+		file, err := gctx.OpenImage(avatar, options)
+		if err == nil {
+			serveImageFile(w, r, file)
+			return
+		}
+		var badRequest *utils.BadRequest
+		var notFound *utils.NotFound
+		if !errors.As(err, &badRequest) && !errors.As(err, &notFound) {
+			handleError(err, w)
+			return
+		}
+	}
+	gctx.serveIdenticon(w, r, uid, options.Size)
+}
+
+// Identicons are cheap and never change, so they're made on the fly
+func (gctx *GonContext) serveIdenticon(w http.ResponseWriter, r *http.Request, uid int64, size int) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, utils.Identicon([]byte(strconv.FormatInt(uid, 10)), size))
+	if handleError(err, w) {
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"identicon-%d-%d"`, uid, size))
+	w.Header().Set("Cache-Control", "public, max-age=86400") // They might set a real avatar later
+	http.ServeContent(w, r, "identicon.png", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+const (
+	ExportBatchSize = 1000
+
+	ExportFormat_Text = "text"
+	ExportFormat_Json = "jsonl"
+	ExportFormat_Html = "html"
+)
+
+type ExportSearch struct {
+	Format string `schema:"format"` // text, jsonl, or html
+	User   int64  `schema:"user"`
+	Start  string `schema:"start"` // A date or datetime, in the viewer's time zone (like CommentSearch)
+	End    string `schema:"end"`   // Same as start; a plain date includes that whole day
+
+	// Start and end, parsed and converted to database dates
+	startDate string
+	endDate   string
+}
+
+// Parse the start and end bounds the same way the comment search does, so the
+// same range exports the same messages
+func (search *ExportSearch) ParseDates(loc *time.Location) error {
+	var err error
+	search.startDate, search.endDate, err = parseDateBounds(search.Start, search.End, loc)
+	return err
+}
+
+// A single message as written to a json lines export
+type ExportMessage struct {
+	Id            int64             `json:"id"`
+	ContentId     int64             `json:"contentId"`
+	Created       string            `json:"createDate"`
+	CreateUserId  int64             `json:"createUserId"`
+	Username      string            `json:"username,omitempty"`
+	Module        string            `json:"module,omitempty"`
+	ReceiveUserId int64             `json:"receiveUserId,omitempty"`
+	Text          string            `json:"text"`
+	Values        map[string]string `json:"values,omitempty"`
+}
+
+func MakeExportMessage(c *contentapi.Comment) ExportMessage {
+	result := ExportMessage{
+		Id:            c.Id,
+		ContentId:     c.ContentId,
+		Created:       c.Created.String(),
+		CreateUserId:  c.CreateUserId,
+		Module:        c.Module,
+		ReceiveUserId: c.ReceiveUserId,
+		Text:          c.Text,
+		Values:        c.Values,
+	}
+	if c.CreateUser != nil {
+		result.Username = c.CreateUser.Username
+	}
+	return result
+}
+
+// The name to show for a comment in the plaintext formats
+func ExportDisplayName(c *contentapi.Comment) string {
+	name := "???"
+	if c.CreateUser != nil {
+		name = c.CreateUser.Username
+	}
+	if nickname := c.Nickname(); nickname != "" {
+		name = nickname
+	}
+	return name
+}
+
+// Write a single comment in irc style. Continuation lines are indented so
+// the transcript is still readable
+func WriteExportText(w io.Writer, c *contentapi.Comment) error {
+	date := c.Created.UTC().Format("2006-01-02 15:04:05")
+	text := strings.ReplaceAll(strings.TrimRight(c.Text, "\r\n"), "\n", "\n    ")
+	var err error
+	if c.IsModule() {
+		receiver := ""
+		if c.ReceiveUserId != 0 {
+			receiver = fmt.Sprintf(" -> %d", c.ReceiveUserId)
+			if c.ReceiveUser != nil {
+				receiver = " -> " + c.ReceiveUser.Username
+			}
+		}
+		_, err = fmt.Fprintf(w, "[%s] * %s (%s%s): %s\n", date, c.Module, ExportDisplayName(c), receiver, text)
+	} else {
+		_, err = fmt.Fprintf(w, "[%s] <%s> %s\n", date, ExportDisplayName(c), text)
+	}
+	return err
+}
+
+// Stream all viewable comments for the given page in batches, oldest first.
+// Only one batch is ever in memory at a time. The search dates must already
+// be parsed
+func (gctx *GonContext) StreamComments(contentId int64, search *ExportSearch, uid int64, handle func([]contentapi.Comment) error) error {
+	var lastId int64
+	for {
+		q := contentapi.NewQuery()
+		q.Sql = "SELECT " + contentapi.GetCommentFields("m") + " FROM messages m WHERE m.contentId = ? AND m.id > ?"
+		q.AddParams(contentId, lastId)
+		q.AndCommentViewable("m", uid, true)
+		if search.User != 0 {
+			q.Sql += " AND m.createUserId = ?"
+			q.AddParams(search.User)
+		}
+		if search.startDate != "" {
+			q.AndTimeAtLeast("m.createDate", search.startDate)
+		}
+		if search.endDate != "" {
+			q.AndTimeBefore("m.createDate", search.endDate)
+		}
+		q.AndViewable("m.contentId", uid)
+		q.Order = "m.id"
+		q.Limit = ExportBatchSize
+		q.Finalize()
+
+		comments := make([]contentapi.Comment, 0, ExportBatchSize)
+		err := gctx.contentdb.Select(&comments, q.Sql, q.Params...)
+		if err != nil {
+			return err
+		}
+		if len(comments) == 0 {
+			return nil
+		}
+
+		_, err = gctx.ApplyCommentExtras(comments)
+		if err != nil {
+			return err
+		}
+
+		err = handle(comments)
+		if err != nil {
+			return err
+		}
+
+		if len(comments) < ExportBatchSize {
+			return nil
+		}
+		lastId = comments[len(comments)-1].Id
+	}
+}
+
+// Write the full comment export for the given page directly to the response.
+// Errors after the first write can't be reported properly (headers are
+// already sent), the error message just ends up at the end of the file
+func (gctx *GonContext) WriteCommentExport(w http.ResponseWriter, hash string, search *ExportSearch, user *UserSession, prefs *Preferences) error {
+	var uid int64
+	if user != nil {
+		uid = int64(user.Uid)
+	}
+
+	err := search.ParseDates(prefs.Location())
+	if err != nil {
+		return err
+	}
+
+	mainpage, err := gctx.GetViewablePage(hash, uid, false)
+	if err != nil {
+		return err
+	}
+
+	// Public rooms are fine for anyone, but private rooms need a login even if
+	// they're somehow viewable
+	if mainpage.Private && user == nil {
+		return &utils.Forbidden{Message: "You must be logged in to export private rooms"}
+	}
+
+	var extension string
+	var handle func([]contentapi.Comment) error
+
+	switch search.Format {
+	case "", ExportFormat_Text:
+		extension = "txt"
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		handle = func(comments []contentapi.Comment) error {
+			for i := range comments {
+				if err := WriteExportText(w, &comments[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case ExportFormat_Json:
+		extension = "jsonl"
+		w.Header().Set("Content-Type", "application/jsonl; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		handle = func(comments []contentapi.Comment) error {
+			for i := range comments {
+				if err := encoder.Encode(MakeExportMessage(&comments[i])); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case ExportFormat_Html:
+		extension = "html"
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		handle = func(comments []contentapi.Comment) error {
+			for i := range comments {
+				if err := gctx.Templates("").ExecuteTemplate(w, "exportmessage", &comments[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	default:
+		return &utils.BadRequest{Message: fmt.Sprintf("Unknown export format %s", search.Format)}
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", mainpage.Hash, extension))
+
+	if search.Format == ExportFormat_Html {
+		err = gctx.Templates("").ExecuteTemplate(w, "exportheader", map[string]any{
+			"mainpage": mainpage,
+			"search":   search,
+			"version":  Version,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	err = gctx.StreamComments(mainpage.Id, search, uid, func(comments []contentapi.Comment) error {
+		err := handle(comments)
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if search.Format == ExportFormat_Html {
+		return gctx.Templates("").ExecuteTemplate(w, "exportfooter", nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+const (
+	EnvPrefix = "GONTENTAPI"
+
+	ExitOk    = 0
+	ExitError = 1
+	ExitUsage = 2
+)
+
+// Settings shared by every command (the flags that come before the command name)
+type Cli struct {
+	ConfigFile string
+	Dir        string
+	Out        io.Writer
+	Overrides  [][2]string // Config fields set from flags (field, raw value), in order
+}
+
+// A single subcommand. Names can be multiple words ("config init")
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(cli *Cli, args []string) error
+}
+
+// Returned by commands when the arguments themselves are bad
+type UsageError struct {
+	Message string
+}
+
+func (e *UsageError) Error() string {
+	return e.Message
+}
+
+func GetCommands() []Command {
+	return []Command{
+		{Name: "serve", Usage: "serve", Description: "Run the web server (the default)", Run: runServe},
+		{Name: "config init", Usage: "config init [-force]", Description: "Write a default config file", Run: runConfigInit},
+		{Name: "config show", Usage: "config show", Description: "Print the effective config (after all overrides) with secrets redacted", Run: runConfigShow},
+		{Name: "config check", Usage: "config check", Description: "Load the config stack and make sure everything it points to works", Run: runConfigCheck},
+		{Name: "thumbnails warm", Usage: "thumbnails warm", Description: "Generate thumbnails for every uploaded image", Run: runThumbnailsWarm},
+		{Name: "duplicates", Usage: "duplicates [-distance N] [-update=false]", Description: "Hash uploaded images and list near duplicates", Run: runDuplicates},
+		{Name: "uploads check", Usage: "uploads check [-report file] [-quarantine dir] [-decode=false]", Description: "Find uploads missing from disk, orphan files, and broken images", Run: runUploadsCheck},
+		{Name: "users list", Usage: "users list [-search name] [-super]", Description: "List users in the database", Run: runUsersList},
+		{Name: "export", Usage: "export [-out dir] [-uid N]", Description: "Render the site to static html files", Run: runExport},
+		{Name: "warc", Usage: "warc [-out file] [-base url] [...]", Description: "Crawl the site into a WARC file", Run: runWarc},
+	}
+}
+
+// Find the command for the given args, returning the leftover args. Longer
+// names win, so "config init" is matched before a hypothetical "config"
+func FindCommand(commands []Command, args []string) (*Command, []string) {
+	var found *Command
+	foundLength := 0
+	for i := range commands {
+		words := strings.Fields(commands[i].Name)
+		if len(words) > len(args) || len(words) <= foundLength {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == commands[i].Name {
+			found = &commands[i]
+			foundLength = len(words)
+		}
+	}
+	if found == nil {
+		return nil, args
+	}
+	return found, args[foundLength:]
+}
+
+func printUsage(out io.Writer, global *flag.FlagSet, commands []Command) {
+	fmt.Fprintf(out, "Usage: gontentapi [-config file] [-dir path] [-<field> value...] <command> [args]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.Usage, c.Description)
+	}
+	tw.Flush()
+	fmt.Fprintf(out, "\nGlobal flags (config fields can also be set with %s_<FIELD> env variables):\n", EnvPrefix)
+	global.SetOutput(out)
+	global.PrintDefaults()
+}
+
+// Parse the global flags and run the requested command, returning the exit code
+func RunCli(args []string) int {
+	cli := &Cli{Out: os.Stdout}
+	commands := GetCommands()
+
+	global := flag.NewFlagSet("gontentapi", flag.ContinueOnError)
+	global.StringVar(&cli.ConfigFile, "config", "config.toml", "Base config file (config0.toml, config1.toml, etc are layered on top)")
+	global.StringVar(&cli.Dir, "dir", "", "Change to this directory before doing anything")
+	for _, name := range utils.ConfigFieldNames(&Config{}) {
+		global.Func(strings.ToLower(name), "Override "+name+" from the config", func(raw string) error {
+			// Make sure the value parses now so bad flags are usage errors
+			err := utils.SetConfigField(&Config{}, name, raw)
+			if err == nil {
+				cli.Overrides = append(cli.Overrides, [2]string{name, raw})
+			}
+			return err
+		})
+	}
+	global.Usage = func() { printUsage(os.Stderr, global, commands) }
+	err := global.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOk
+		}
+		return ExitUsage
+	}
+
+	rest := global.Args()
+	if len(rest) > 0 && rest[0] == "help" {
+		printUsage(cli.Out, global, commands)
+		return ExitOk
+	}
+
+	var command *Command
+	if len(rest) == 0 {
+		command = &commands[0]
+	} else {
+		command, rest = FindCommand(commands, rest)
+		if command == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", strings.Join(rest, " "))
+			printUsage(os.Stderr, global, commands)
+			return ExitUsage
+		}
+	}
+
+	if cli.Dir != "" {
+		err = os.Chdir(cli.Dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return ExitError
+		}
+	}
+
+	err = command.Run(cli, rest)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOk
+		}
+		var usageErr *UsageError
+		if errors.As(err, &usageErr) {
+			// An empty message means the flag package already printed the problem
+			if usageErr.Message != "" {
+				fmt.Fprintf(os.Stderr, "%s\nUsage: gontentapi %s\n", err, command.Usage)
+			}
+			return ExitUsage
+		}
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return ExitError
+	}
+	return ExitOk
+}
+
+// Load the config this cli points to. Precedence (last wins): the config
+// file, the numbered config files on top of it (config0.toml, config1.toml...),
+// GONTENTAPI_<FIELD> environment variables, then flags. Also returns where
+// everything came from. The final config is normalized and validated; all
+// problems are reported together as a *utils.ConfigProblems
+func (cli *Cli) LoadConfig() (*Config, []string, error) {
+	config, sources, problems, err := loadConfig(cli.ConfigFile)
+	if err != nil {
+		return nil, sources, err
+	}
+	envs, err := utils.ApplyConfigEnv(config, EnvPrefix, os.LookupEnv)
+	sources = append(sources, envs...)
+	if err != nil {
+		return nil, sources, err
+	}
+	for _, o := range cli.Overrides {
+		err = utils.SetConfigField(config, o[0], o[1])
+		if err != nil {
+			return nil, sources, fmt.Errorf("-%s: %w", strings.ToLower(o[0]), err)
+		}
+		sources = append(sources, "-"+strings.ToLower(o[0]))
+	}
+	config.Normalize()
+	problems = append(problems, config.Validate()...)
+	if len(problems) > 0 {
+		return nil, sources, &utils.ConfigProblems{Problems: problems}
+	}
+	return config, sources, nil
+}
+
+// Load the config and create the full context from it
+func (cli *Cli) LoadContext() (*Config, *GonContext, error) {
+	config, sources, err := cli.LoadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Loaded config from: %s", strings.Join(sources, ", "))
+	gctx, err := NewContext(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, gctx, nil
+}
+
+// Parse the flags for a command. Bad flags are a usage error
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return &UsageError{}
+	}
+	return err
+}
+
+// Commands that take no arguments should complain if they're given some
+func noExtraArgs(flags *flag.FlagSet) error {
+	if flags.NArg() > 0 {
+		return &UsageError{Message: fmt.Sprintf("Unexpected arguments: %s", strings.Join(flags.Args(), " "))}
+	}
+	return nil
+}
+
+func runConfigInit(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("config init", flag.ContinueOnError)
+	force := flags.Bool("force", false, "Overwrite the config if it already exists")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
+	if _, err = os.Stat(cli.ConfigFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists (use -force to overwrite)", cli.ConfigFile)
+	}
+	err = os.WriteFile(cli.ConfigFile, []byte(GetDefaultConfig_Toml()), 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.Out, "Generated default config at %s\n", cli.ConfigFile)
+	return nil
+}
+
+func runConfigCheck(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
+	config, sources, err := cli.LoadConfig()
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		fmt.Fprintf(cli.Out, "Loaded %s\n", source)
+	}
+	gctx, err := NewContext(config)
+	if err != nil {
+		return err
+	}
+	err = gctx.contentdb.Ping()
+	if err != nil {
+		return fmt.Errorf("database %s: %w", config.Database, err)
+	}
+	fmt.Fprintf(cli.Out, "Config OK\n")
+	return nil
+}
+
+func runConfigShow(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("config show", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
+	config, sources, err := cli.LoadConfig()
+	if err != nil {
+		return err
+	}
+	raw, err := toml.Marshal(utils.RedactConfig(config))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.Out, "# Effective config from: %s\n%s", strings.Join(sources, ", "), raw)
+	return nil
+}
+
+func runThumbnailsWarm(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("thumbnails warm", flag.ContinueOnError)
+	srcset := flags.Bool("srcset", true, "Also make the high-DPI sizes pages ask for")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
+	config, gctx, err := cli.LoadContext()
+	if err != nil {
+		return err
+	}
+
+	hashes := make([]string, 0)
+	err = gctx.contentdb.Select(&hashes, "SELECT hash FROM content WHERE contentType = ? AND deleted = 0 ORDER BY id", contentapi.ContentType_File)
+	if err != nil {
+		return err
+	}
+	variants := []ImageOptions{gctx.ThumbnailOptions()}
+	if *srcset {
+		for _, scale := range []int{2, 3} {
+			if size := config.ThumbnailSize * scale; config.AllowedImageSize(size) {
+				variant := gctx.ThumbnailOptions()
+				variant.Size = size
+				variants = append(variants, variant)
+			}
+		}
+	}
+
+	// Make every variant for one upload. Uploads that can't be thumbnailed
+	// (missing or not images) are skipped, not errors
+	warm := func(hash string) (bool, error) {
+		for _, variant := range variants {
+			file, err := gctx.OpenImage(hash, variant)
+			if err != nil {
+				var badRequest *utils.BadRequest
+				var notFound *utils.NotFound
+				if errors.As(err, &badRequest) || errors.As(err, &notFound) {
+					return false, nil
+				}
+				return false, fmt.Errorf("%s: %w", hash, err)
+			}
+			file.Close()
+		}
+		return true, nil
+	}
+
+	// Generation is limited to ThumbnailWorkers at once anyway, this just
+	// keeps them all busy
+	var ready, skipped atomic.Int64
+	jobs := make(chan string)
+	errs := make(chan error, config.ThumbnailWorkers)
+	var wg sync.WaitGroup
+	for range config.ThumbnailWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range jobs {
+				ok, err := warm(hash)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if ok {
+					ready.Add(1)
+				} else {
+					skipped.Add(1)
+				}
+			}
+		}()
+	}
+
+	// Progress every few seconds, it can take a while
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	start := time.Now()
+	var failure error
+queue:
+	for _, hash := range hashes {
+		for {
+			select {
+			case jobs <- hash:
+				continue queue
+			case failure = <-errs:
+				break queue
+			case <-ticker.C:
+				finished := ready.Load() + skipped.Load()
+				log.Printf("Thumbnails: %d/%d (%.1f/s)", finished, len(hashes), float64(finished)/time.Since(start).Seconds())
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if failure == nil {
+		select {
+		case failure = <-errs:
+		default:
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+	fmt.Fprintf(cli.Out, "Thumbnails ready: %d, skipped (missing or not images): %d, cache size: %.1fMB\n",
+		ready.Load(), skipped.Load(), float64(gctx.thumbnailCache.Size())/1024/1024)
+	return nil
+}
+
+func runUsersList(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("users list", flag.ContinueOnError)
+	search := flags.String("search", "", "Only users whose name contains this")
+	super := flags.Bool("super", false, "Only super users")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
+	_, gctx, err := cli.LoadContext()
+	if err != nil {
+		return err
+	}
+
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT " + contentapi.GetUserFields("u") + " FROM users u WHERE 1"
+	if *search != "" {
+		q.Sql += " AND u.username LIKE ?"
+		q.AddParams("%" + *search + "%")
+	}
+	if *super {
+		q.Sql += " AND u.super = 1"
+	}
+	q.Order = "u.id"
+	q.Finalize()
+
+	users := make([]contentapi.User, 0)
+	err = gctx.contentdb.Select(&users, q.Sql, q.Params...)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(cli.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tUSERNAME\tCREATED\tSUPER\n")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", u.Id, u.Username, u.Created.Format("2006-01-02 15:04:05"), u.Super)
+	}
+	return tw.Flush()
+}
+
+func runDuplicates(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("duplicates", flag.ContinueOnError)
+	distance := flags.Int("distance", DefaultDuplicateDistance, fmt.Sprintf("Max bits different (0-%d, 0 is identical)", MaxDuplicateDistance))
+	update := flags.Bool("update", true, "Hash new and changed uploads first")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
+	if *distance < 0 || *distance > MaxDuplicateDistance {
+		return &UsageError{Message: fmt.Sprintf("-distance must be between 0 and %d", MaxDuplicateDistance)}
+	}
+	_, gctx, err := cli.LoadContext()
+	if err != nil {
+		return err
+	}
+
+	if *update {
+		// Progress every few seconds, the first run can take a while
+		last := time.Now()
+		stats, err := gctx.UpdateImageHashes(0, func(done int, total int) {
+			if time.Since(last) >= 2*time.Second {
+				last = time.Now()
+				log.Printf("Hashing: %d/%d", done, total)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cli.Out, "Hashed: %d, not images: %d, unchanged: %d, missing: %d, failed: %d\n\n",
+			stats.Hashed, stats.NotImages, stats.Unchanged, stats.Missing, stats.Failed)
+	}
+
+	groups, err := gctx.FindDuplicates(*distance)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(cli.Out, 0, 0, 2, ' ', 0)
+	for i, group := range groups {
+		fmt.Fprintf(tw, "GROUP %d\tDIFF\tNAME\tPAGES\n", i+1)
+		for _, image := range group {
+			pages := make([]string, 0, len(image.Pages))
+			for _, p := range image.Pages {
+				pages = append(pages, p.Hash)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", image.Upload.Hash, image.Distance, image.Upload.Name, strings.Join(pages, ", "))
+		}
+		fmt.Fprintf(tw, "\t\t\t\n")
+	}
+	fmt.Fprintf(tw, "%d groups of near duplicates\n", len(groups))
+	return tw.Flush()
+}
+
+func runUploadsCheck(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("uploads check", flag.ContinueOnError)
+	reportFile := flags.String("report", "", "Also write the full report as json to this file")
+	quarantine := flags.String("quarantine", "", "Move orphan files (no content row) into this folder")
+	decode := flags.Bool("decode", true, "Decode every image to make sure it isn't broken (slow)")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
+	_, gctx, err := cli.LoadContext()
+	if err != nil {
+		return err
+	}
+
+	report, err := gctx.CheckUploads(*decode)
+	if err != nil {
+		return err
+	}
+	problems := report.ProblemCount()
+	if *quarantine != "" && len(report.Orphans) > 0 {
+		// Still write whatever report we have if only some got moved
+		err = gctx.QuarantineOrphans(report, *quarantine)
+	}
+	if *reportFile != "" {
+		raw, jsonErr := json.MarshalIndent(report, "", "  ")
+		if jsonErr == nil {
+			jsonErr = os.WriteFile(*reportFile, append(raw, '\n'), 0644)
+		}
+		if jsonErr != nil {
+			return jsonErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(cli.Out, 0, 0, 2, ' ', 0)
+	list := func(title string, found []UploadProblem) {
+		if len(found) == 0 {
+			return
+		}
+		fmt.Fprintf(tw, "%s (%d)\tID\tNAME\tTYPE\tBYTES\tERROR\n", title, len(found))
+		for _, p := range found {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\n", p.Hash, p.ContentId, p.Name, p.MimeType, p.Bytes, p.Error)
+		}
+		fmt.Fprintf(tw, "\t\t\t\t\t\n")
+	}
+	list("MISSING", report.Missing)
+	list("ORPHANS", report.Orphans)
+	list("EMPTY", report.Empty)
+	list("UNDECODABLE", report.Undecodable)
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.Out, "Checked %d uploads and %d files: %d missing, %d orphans, %d empty, %d undecodable\n",
+		report.Uploads, report.Files, len(report.Missing), len(report.Orphans), len(report.Empty), len(report.Undecodable))
+	if len(report.Quarantined) > 0 {
+		fmt.Fprintf(cli.Out, "Moved %d orphans to %s\n", len(report.Quarantined), *quarantine)
+	}
+	// Fail so scripts notice
+	if problems > 0 {
+		return fmt.Errorf("%d problems with uploads", problems)
+	}
+	return nil
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/randomouscrap98/gontentapi/utils"
@@ -10,39 +16,74 @@ import (
 type Config struct {
 	Address              string         // Full address to host on (includes IP to limit to localhost/etc)
 	ShutdownTime         utils.Duration // Time to wait for server to shutdown
-	StaticFiles          string         // Where the static files for ALL endpoints go
+	StaticFiles          string         // Static files that override the built-in ones (optional)
 	HeaderLimit          int            // Maximum allowed header size
 	Timeout              utils.Duration // How long a connection is allowed to last
 	Database             string         // Path to the contentapi database file
 	Uploads              string         // Path to all the uploaded files
-	Templates            string         // Path to all the templates
+	Templates            string         // Templates that override the built-in ones (optional)
+	Themes               string         // Folder of extra themes (one folder per theme, optional)
+	DefaultTheme         string         // Theme for anyone who hasn't picked one
+	ThemeCookie          string         // Name of the theme choice cookie
 	RootPath             string         // The root path to our service (the url path)
 	LoginCookie          string         // Name of the login cookie
 	LoginExpire          utils.Duration // How long the login cookie lasts
 	MaxSessions          int            // How many total sessions can exist
-	CommentsPerPage      int            // How many comments to display per page (not user settable)
+	CommentsPerPage      int            // Default comments per page (users can change it within the bounds below)
+	MinCommentsPerPage   int            // Lowest comments per page a user can pick
+	MaxCommentsPerPage   int            // Highest comments per page a user can pick
+	SidecarDatabase      string         // Our own database (preferences, etc), created if needed
+	PreferencesCookie    string         // Name of the preferences cookie (for users not logged in)
 	ThumbnailFolder      string         // Where to store thumbnails (will be created)
 	ThumbnailSize        int            // Fixed size for thumbnail generation
 	ThumbnailJpegQuality int            // Quality of jpeg thumbnails
+	ThumbnailWorkers     int            // How many thumbnails can be generated at once
+	ThumbnailMaxPixels   int            // Images bigger than this (width * height) don't get thumbnails
+	ThumbnailMaxFrames   int            // Animated thumbnails get at most this many frames
+	ThumbnailFailureTime utils.Duration // How long to remember uploads that can't be thumbnailed
+	ImageSizes           []int          // Sizes images can be requested at (?size=), besides ThumbnailSize
+	ThumbnailCacheLimit  int            // Megabytes of thumbnails to keep (least recently used go first). 0 for no limit
+	InlineUploadTypes    []string       // Mime types of uploads browsers only display (type/* for a whole family); svg and xml never count
+	ActiveUploads        string         // What to do with everything else: "sandbox" (show it without scripts) or "download"
+	StripUploadLocation  bool           // Serve jpegs without their GPS (exif) and XMP data
 }
 
 func GetDefaultConfig_Toml() string {
 	baseConfig := `# Config auto-generated on %s
 Address=":5030"                # Where to run the server
 ShutdownTime="10s"             # How long to wait for the server to shutdown
-StaticFiles="static"           # Where ALL static files go
+StaticFiles=""                 # Optional folder of static files to use over the built-in ones
 HeaderLimit=10000              # Maximum allowed header size on POST
 Timeout="30s"                  # How long a connection is allowed to last
 Database="data/content.db"     # Path to the contentapi database file
 Uploads="data/uploads"         # Path to the contentapi uploads (images)
-Templates="static/templates"   # Path to all the templates
+Templates=""                   # Optional folder of templates to use over the built-in ones
+Themes=""                      # Optional folder of themes (each theme a folder with theme.css and templates)
+DefaultTheme="default"         # Theme for users who haven't picked one ("default" is no theme)
+ThemeCookie="gontentapi_theme" # Name of theme cookie
 LoginCookie="gontentapi_login" # Name of login cookie
 LoginExpire="1500h"            # How long the login cookie lasts
 MaxSessions=10000              # How many total sessions can exist
-CommentsPerPage=100            # How many comments to display per page
+CommentsPerPage=100            # Default comments per page
+MinCommentsPerPage=10          # Users can pick comments per page between these
+MaxCommentsPerPage=500
+SidecarDatabase="data/gontentapi.db"  # Our own database (preferences, etc). Created if needed
+PreferencesCookie="gontentapi_prefs"  # Name of preferences cookie (users who aren't logged in)
 ThumbnailFolder="data/thumbnails"  # Where to store thumbnails (will be created)
 ThumbnailSize=100              # Thumbnails are a fixed size (and maybe square)
 ThumbnailJpegQuality=85        # Quality of thumbnail jpegs
+ThumbnailWorkers=4             # How many thumbnails can be generated at once (the rest wait)
+ThumbnailMaxPixels=50000000    # Images with more pixels than this get an icon instead of a thumbnail (all frames count for gifs)
+ThumbnailMaxFrames=100         # Animated gif thumbnails skip frames to stay under this (more than 10x this gets an icon)
+ThumbnailFailureTime="10m"     # How long to remember uploads that couldn't be thumbnailed
+ImageSizes=[50, 200, 300, 400, 800]  # Sizes images can be resized to with ?size= (ThumbnailSize always works)
+ThumbnailCacheLimit=1000       # Megabytes of thumbnails to keep; least recently used are deleted first (0 = no limit)
+# Uploads are always served sandboxed (no scripts, forms, etc). Only these types
+# are shown as-is; anything else could run scripts on our site (svg and xml
+# types never count as these), so it can be forced to download instead
+InlineUploadTypes=["image/*", "audio/*", "video/*", "text/plain"]
+ActiveUploads="sandbox"        # Everything else: "sandbox" (shown sandboxed) or "download"
+StripUploadLocation=true       # Remove GPS and XMP data from jpegs when serving them (the files aren't changed)
 
 # MUST set to empty path if hosted at root!
 RootPath=""                   # Root path for our service. Useful when running behind a reverse proxy
@@ -52,3 +93,183 @@ RootPath=""                   # Root path for our service. Useful when running b
 		time.Now().Format(time.RFC3339),
 	)
 }
+
+// Fix up values that have an obvious intended meaning (currently just RootPath,
+// which must start with / and never end with one)
+func (config *Config) Normalize() {
+	root := strings.TrimRight(strings.TrimSpace(config.RootPath), "/")
+	if root != "" && !strings.HasPrefix(root, "/") {
+		root = "/" + root
+	}
+	config.RootPath = root
+}
+
+// Check the whole config, returning every problem found (empty means it's fine)
+func (config *Config) Validate() []string {
+	problems := make([]string, 0)
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	between := func(name string, value int, low int, high int) {
+		if value < low || value > high {
+			add("%s must be between %d and %d (is %d)", name, low, high, value)
+		}
+	}
+
+	if config.Address == "" {
+		add("Address must be set (ex: \":5030\")")
+	}
+	between("HeaderLimit", config.HeaderLimit, 1000, 100_000_000)
+	between("MaxSessions", config.MaxSessions, 1, 100_000_000)
+	between("MinCommentsPerPage", config.MinCommentsPerPage, 1, 10_000)
+	between("MaxCommentsPerPage", config.MaxCommentsPerPage, config.MinCommentsPerPage, 10_000)
+	between("CommentsPerPage", config.CommentsPerPage, config.MinCommentsPerPage, config.MaxCommentsPerPage)
+	between("ThumbnailSize", config.ThumbnailSize, 8, 4096)
+	between("ThumbnailJpegQuality", config.ThumbnailJpegQuality, 1, 100)
+	between("ThumbnailWorkers", config.ThumbnailWorkers, 1, 256)
+	between("ThumbnailMaxPixels", config.ThumbnailMaxPixels, 1, 1_000_000_000)
+	between("ThumbnailMaxFrames", config.ThumbnailMaxFrames, 1, 10_000)
+	between("ThumbnailCacheLimit", config.ThumbnailCacheLimit, 0, 100_000_000)
+	for _, size := range config.ImageSizes {
+		between("ImageSizes", size, 8, 4096)
+	}
+	if config.Timeout <= 0 {
+		add("Timeout must be more than 0")
+	}
+	if config.LoginExpire <= 0 {
+		add("LoginExpire must be more than 0")
+	}
+	if config.ActiveUploads != ActiveUploads_Sandbox && config.ActiveUploads != ActiveUploads_Download {
+		add("ActiveUploads must be %q or %q (is %q)", ActiveUploads_Sandbox, ActiveUploads_Download, config.ActiveUploads)
+	}
+	for _, t := range config.InlineUploadTypes {
+		if kind, sub, ok := strings.Cut(t, "/"); !ok || kind == "" || sub == "" {
+			add("InlineUploadTypes must be types like \"image/png\" or \"image/*\" (has %q)", t)
+		}
+	}
+	if config.ThumbnailFailureTime < 0 {
+		add("ThumbnailFailureTime can't be negative")
+	}
+	if config.LoginCookie == "" {
+		add("LoginCookie must be set")
+	}
+	if config.ThemeCookie == "" {
+		add("ThemeCookie must be set")
+	}
+	if config.PreferencesCookie == "" {
+		add("PreferencesCookie must be set")
+	}
+
+	// The built-in static files and templates are used when these aren't set
+	if config.StaticFiles != "" {
+		if err := checkReadableDir(config.StaticFiles); err != nil {
+			add("StaticFiles: %s", err)
+		}
+	}
+	if err := checkReadableDir(config.Uploads); err != nil {
+		add("Uploads: %s", err)
+	}
+	if config.Templates != "" {
+		if err := checkReadableDir(config.Templates); err != nil {
+			add("Templates: %s", err)
+		}
+	}
+	if config.Themes != "" {
+		if err := checkReadableDir(config.Themes); err != nil {
+			add("Themes: %s", err)
+		}
+	}
+	if config.DefaultTheme != "" && config.DefaultTheme != DefaultThemeName {
+		themes, err := ListThemes(config)
+		if err == nil && !slices.Contains(themes, config.DefaultTheme) {
+			add("DefaultTheme: no theme named %s (have: %s)", config.DefaultTheme, strings.Join(themes, ", "))
+		}
+	}
+	if err := checkReadableFile(config.Database); err != nil {
+		add("Database: %s", err)
+	}
+	if err := checkWritableDir(config.ThumbnailFolder); err != nil {
+		add("ThumbnailFolder: %s", err)
+	}
+	if config.SidecarDatabase == "" {
+		add("SidecarDatabase: not set")
+	} else if err := checkWritableDir(filepath.Dir(config.SidecarDatabase)); err != nil {
+		add("SidecarDatabase: %s", err)
+	}
+
+	return problems
+}
+
+func checkReadableDir(path string) error {
+	if path == "" {
+		return fmt.Errorf("not set")
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	stat, err := dir.Stat()
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	_, err = dir.Readdirnames(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func checkReadableFile(path string) error {
+	if path == "" {
+		return fmt.Errorf("not set")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// The folder doesn't have to exist yet (it's created on startup), but then its
+// closest existing parent must be writable
+func checkWritableDir(path string) error {
+	if path == "" {
+		return fmt.Errorf("not set")
+	}
+	existing := path
+	for {
+		stat, err := os.Stat(existing)
+		if err == nil {
+			if !stat.IsDir() {
+				return fmt.Errorf("%s is not a directory", existing)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return err
+		}
+		existing = parent
+	}
+	test, err := os.CreateTemp(existing, ".writecheck")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", existing, err)
+	}
+	test.Close()
+	return os.Remove(test.Name())
+}
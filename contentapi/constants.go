@@ -7,3 +7,28 @@ const (
 	ContentType_Userpage = 4
 	ContentType_System   = 5
 )
+
+// The actions recorded in content_history (these are flags in contentapi but
+// a history entry only ever has one)
+const (
+	UserAction_Create = 1
+	UserAction_Read   = 2
+	UserAction_Update = 4
+	UserAction_Delete = 8
+)
+
+// Get a human readable name for the given history action
+func ActionName(action int) string {
+	switch action {
+	case UserAction_Create:
+		return "create"
+	case UserAction_Read:
+		return "read"
+	case UserAction_Update:
+		return "update"
+	case UserAction_Delete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
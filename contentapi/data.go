@@ -1,6 +1,7 @@
 package contentapi
 
 import (
+	"encoding/json"
 	"fmt"
 	//"log"
 	// "time"
@@ -11,7 +12,7 @@ type User struct {
 	Id       int64  `db:"id"`
 	Username string `db:"username"`
 	Avatar   string `db:"avatar"`
-	Created  string `db:"createDate"`
+	Created  Time   `db:"createDate"`
 	Super    bool   `db:"super"`
 }
 
@@ -30,7 +31,7 @@ type Content struct {
 	Hash         string `db:"hash"`
 	Text         string `db:"text"`
 	ParentId     int64  `db:"parentId"`
-	Created      string `db:"createDate"`
+	Created      Time   `db:"createDate"`
 	ContentType  int    `db:"contentType"`
 	CreateUserId int64  `db:"createUserId"`
 
@@ -60,16 +61,20 @@ func GetContentFields(table string, allFields bool) string {
 		table, bigFields)
 }
 
-// Basic COMMENT data from database (no modules in this system)
+// Basic COMMENT data from database. Module messages are also comments, they
+// just have a module name and possibly a receiver
 type Comment struct {
-	Id           int64  `db:"id"`
-	ContentId    int64  `db:"contentId"`
-	Created      string `db:"createDate"`
-	Text         string `db:"text"`
-	CreateUserId int64  `db:"createUserId"`
+	Id            int64  `db:"id"`
+	ContentId     int64  `db:"contentId"`
+	Created       Time   `db:"createDate"`
+	Text          string `db:"text"`
+	CreateUserId  int64  `db:"createUserId"`
+	Module        string `db:"module"`
+	ReceiveUserId int64  `db:"receiveUserId"`
 
-	Values     map[string]string
-	CreateUser *User
+	Values      map[string]string
+	CreateUser  *User
+	ReceiveUser *User
 }
 
 // Return all fields for SELECT for comment query
@@ -77,5 +82,69 @@ func GetCommentFields(table string) string {
 	if table != "" {
 		table += "."
 	}
-	return fmt.Sprintf("%[1]sid,%[1]scontentId,%[1]screateDate,%[1]stext,%[1]screateUserId", table)
+	return fmt.Sprintf("%[1]sid,%[1]scontentId,%[1]screateDate,%[1]stext,%[1]screateUserId,"+
+		"COALESCE(%[1]smodule,'') AS module,%[1]sreceiveUserId", table)
+}
+
+// Whether this comment came from a module rather than a user
+func (c *Comment) IsModule() bool {
+	return c.Module != ""
+}
+
+// Get the first value found for any of the given keys (old clients weren't
+// consistent about short vs long keys)
+func (c *Comment) GetValue(keys ...string) string {
+	for _, k := range keys {
+		v, ok := c.Values[k]
+		if ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// The nickname the user posted this message with (empty if none)
+func (c *Comment) Nickname() string {
+	return c.GetValue("n", "nickname")
+}
+
+// The markup language this message was written in (empty if unknown)
+func (c *Comment) Markup() string {
+	return c.GetValue("m", "markup")
+}
+
+// The avatar to display for this message. A per-message avatar takes
+// priority over the user's avatar
+func (c *Comment) Avatar() string {
+	avatar := c.GetValue("a", "avatar")
+	if avatar == "" && c.CreateUser != nil {
+		avatar = c.CreateUser.Avatar
+	}
+	return avatar
+}
+
+// A single value attached to a message. Old chat clients stored things like
+// nicknames and markup here
+type MessageValue struct {
+	MessageId int64  `db:"messageId"`
+	Key       string `db:"key"`
+	Value     string `db:"value"`
+}
+
+// Return all fields for SELECT for message value query
+func GetMessageValueFields(table string) string {
+	if table != "" {
+		table += "."
+	}
+	return fmt.Sprintf("%[1]smessageId,%[1]skey,%[1]svalue", table)
+}
+
+// Values are stored as json in contentapi. Most are strings, so unwrap those;
+// anything else is left as the raw json
+func DecodeValue(raw string) string {
+	var result string
+	if json.Unmarshal([]byte(raw), &result) == nil {
+		return result
+	}
+	return raw
 }
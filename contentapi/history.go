@@ -0,0 +1,89 @@
+package contentapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A single revision of some content from content_history. The snapshot is
+// not retrieved for lists, use GetHistoryFields to control that
+type ContentHistory struct {
+	Id           int64  `db:"id"`
+	ContentId    int64  `db:"contentId"`
+	Action       int    `db:"action"`
+	Created      Time   `db:"createDate"`
+	CreateUserId int64  `db:"createUserId"`
+	Snapshot     []byte `db:"snapshot"`
+
+	PreviousId int64 // The revision before this one (0 if none)
+	CreateUser *User
+}
+
+// Retrieve the list of history fields based on the table name. The snapshot
+// can be large, so only include it if you need it
+func GetHistoryFields(table string, snapshot bool) string {
+	if table != "" {
+		table += "."
+	}
+	var snapshotField string
+	if snapshot {
+		snapshotField = table + "snapshot"
+	} else {
+		snapshotField = "NULL AS snapshot"
+	}
+	return fmt.Sprintf("%[1]sid,%[1]scontentId,%[1]saction,%[1]screateDate,%[1]screateUserId,%[2]s", table, snapshotField)
+}
+
+// The name of the action for this revision (create/update/etc)
+func (h *ContentHistory) ActionName() string {
+	return ActionName(h.Action)
+}
+
+// Attempt to apply a user to the given history
+func (h *ContentHistory) ApplyUser(users map[int64]*User) *User {
+	user, ok := users[h.CreateUserId]
+	if !ok {
+		return nil
+	}
+	h.CreateUser = user
+	return user
+}
+
+// The parts of a contentapi snapshot we care about. The snapshot has MUCH
+// more, but we only display the basics. Json matching is case insensitive,
+// which is good because I don't remember the casing contentapi used
+type ContentSnapshot struct {
+	Id          int64  `json:"id"`
+	Name        string `json:"name"`
+	Text        string `json:"text"`
+	ContentType int    `json:"contentType"`
+}
+
+// Parse the raw snapshot stored in content_history. Contentapi compressed
+// these with gzip, but allow plain json just in case
+func ParseSnapshot(raw []byte) (*ContentSnapshot, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty snapshot")
+	}
+	data := raw
+	if len(raw) > 2 && raw[0] == 0x1f && raw[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		data, err = io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var result ContentSnapshot
+	err := json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -19,8 +19,12 @@ func (c *Content) ApplyUser(users map[int64]*User) *User {
 	return user
 }
 
-// Attempt to apply a user to the given comment
+// Attempt to apply a user to the given comment. Also applies the receiving
+// user if there is one, but only the create user is returned
 func (c *Comment) ApplyUser(users map[int64]*User) *User {
+	if c.ReceiveUserId != 0 {
+		c.ReceiveUser = users[c.ReceiveUserId]
+	}
 	user, ok := users[c.CreateUserId]
 	if !ok {
 		return nil
@@ -28,3 +32,28 @@ func (c *Comment) ApplyUser(users map[int64]*User) *User {
 	c.CreateUser = user
 	return user
 }
+
+// Map message values by message id, decoding the values as we go
+func GetMappedMessageValues(values []MessageValue) map[int64]map[string]string {
+	result := make(map[int64]map[string]string)
+	for _, v := range values {
+		mvals, ok := result[v.MessageId]
+		if !ok {
+			mvals = make(map[string]string)
+			result[v.MessageId] = mvals
+		}
+		mvals[v.Key] = DecodeValue(v.Value)
+	}
+	return result
+}
+
+// Attempt to apply values to the given comment. Comments without values
+// get an empty map
+func (c *Comment) ApplyValues(values map[int64]map[string]string) map[string]string {
+	mvals, ok := values[c.Id]
+	if !ok {
+		mvals = make(map[string]string)
+	}
+	c.Values = mvals
+	return mvals
+}
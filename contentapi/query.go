@@ -44,16 +44,48 @@ func (q *Query) AndViewable(cidField string, user int64) {
 	q.Params = append(q.Params, user, user)
 }
 
-// Add the query for comment viewable (and is a comment). Make sure you already
-// have a where clause (you can do WHERE 1)
-func (q *Query) AndCommentViewable(table string) {
+// Add the query for comment viewable. Module messages sent to a specific user
+// are only viewable by that user, and can be excluded entirely. Make sure you
+// already have a where clause (you can do WHERE 1)
+func (q *Query) AndCommentViewable(table string, user int64, modules bool) {
 	if table != "" {
 		table += "."
 	}
-	q.Sql += fmt.Sprintf(" AND %[1]sdeleted = 0 AND %[1]smodule IS NULL", table)
+	q.Sql += fmt.Sprintf(" AND %[1]sdeleted = 0 AND %[1]sreceiveUserId IN (0, ?)", table)
+	q.Params = append(q.Params, user)
+	if !modules {
+		q.Sql += fmt.Sprintf(" AND %[1]smodule IS NULL", table)
+	}
 }
 
 // Add the finishing touches (limit, skip, etc)
+// Only rows where the date column is at or after the given database date (see
+// FormatDbTime). Stored dates may use a space instead of the T, which sorts
+// before it, so the boundary day is checked in both shapes. The column itself
+// is compared as-is so its index still works
+func (q *Query) AndTimeAtLeast(column string, date string) {
+	day, clock, found := strings.Cut(date, "T")
+	if !found {
+		q.Sql += " AND " + column + " >= ?"
+		q.AddParams(date)
+		return
+	}
+	q.Sql += fmt.Sprintf(" AND (%[1]s >= ? OR (%[1]s >= ? AND %[1]s < ?))", column)
+	q.AddParams(date, day+" "+clock, day+"T")
+}
+
+// Only rows where the date column is before the given database date (see AndTimeAtLeast)
+func (q *Query) AndTimeBefore(column string, date string) {
+	day, clock, found := strings.Cut(date, "T")
+	if !found {
+		q.Sql += " AND " + column + " < ?"
+		q.AddParams(date)
+		return
+	}
+	q.Sql += fmt.Sprintf(" AND (%[1]s < ? OR (%[1]s >= ? AND %[1]s < ?))", column)
+	q.AddParams(day+" "+clock, day+"T", date)
+}
+
 func (q *Query) Finalize() {
 	if q.Order != "" {
 		q.Sql += " ORDER BY " + q.Order
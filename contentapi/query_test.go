@@ -0,0 +1,78 @@
+package contentapi
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestTimeBounds(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE messages (id INTEGER PRIMARY KEY, createDate TEXT); CREATE INDEX messages_date ON messages(createDate)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both separators, on either side of noon on the boundary day
+	for i, date := range []string{"2021-05-01T11:00:00", "2021-05-01 11:00:00", "2021-05-01T13:00:00.5Z", "2021-05-01 13:00:00", "2021-04-30 23:00:00", "2021-05-02T01:00:00"} {
+		_, err = db.Exec("INSERT INTO messages (id, createDate) VALUES (?, ?)", i+1, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(q Query) []int64 {
+		result := make([]int64, 0)
+		err := db.Select(&result, q.Sql+" ORDER BY id", q.Params...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	q := NewQuery()
+	q.Sql = "SELECT id FROM messages WHERE 1"
+	q.AndTimeAtLeast("createDate", "2021-05-01T12:00:00")
+	if result := ids(q); !slices.Equal(result, []int64{3, 4, 6}) {
+		t.Fatalf("Expected everything from noon on, got %v", result)
+	}
+	q = NewQuery()
+	q.Sql = "SELECT id FROM messages WHERE 1"
+	q.AndTimeBefore("createDate", "2021-05-01T12:00:00")
+	if result := ids(q); !slices.Equal(result, []int64{1, 2, 5}) {
+		t.Fatalf("Expected everything before noon, got %v", result)
+	}
+	// Plain days don't care about the separator at all
+	q = NewQuery()
+	q.Sql = "SELECT id FROM messages WHERE 1"
+	q.AndTimeAtLeast("createDate", "2021-05-01")
+	q.AndTimeBefore("createDate", "2021-05-02")
+	if result := ids(q); !slices.Equal(result, []int64{1, 2, 3, 4}) {
+		t.Fatalf("Expected the whole day, got %v", result)
+	}
+
+	// The column is left alone, so the index is used
+	plan := make([]struct {
+		Id      int    `db:"id"`
+		Parent  int    `db:"parent"`
+		NotUsed int    `db:"notused"`
+		Detail  string `db:"detail"`
+	}, 0)
+	q = NewQuery()
+	q.Sql = "SELECT id FROM messages WHERE 1"
+	q.AndTimeAtLeast("createDate", "2021-05-01T12:00:00")
+	err = db.Select(&plan, "EXPLAIN QUERY PLAN "+q.Sql, q.Params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range plan {
+		if strings.HasPrefix(step.Detail, "SCAN") {
+			t.Fatalf("Expected the date index to be used, got a full scan")
+		}
+	}
+}
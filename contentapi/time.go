@@ -0,0 +1,71 @@
+package contentapi
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How we write dates for comparing against the database. Stored dates may
+// have fractional seconds and a zone marker after this, and may use a space
+// instead of the T; compare with Query.AndTimeAtLeast/AndTimeBefore so that
+// doesn't matter
+const DbTimeFormat = "2006-01-02T15:04:05"
+
+// A date from the database. SQLite stores dates as text, so they're parsed
+// into a real time (always UTC) when scanned
+type Time struct {
+	time.Time
+}
+
+// Parse a date as stored in the database. Dates without a zone are UTC
+func ParseTime(date string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999"} {
+		if parsed, err := time.ParseInLocation(layout, date, time.UTC); err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %s", date)
+}
+
+// Format a time so it can be compared against database dates (see DbTimeFormat)
+func FormatDbTime(t time.Time) string {
+	return t.UTC().Format(DbTimeFormat)
+}
+
+// Put user-given date bounds in the same shape as FormatDbTime
+func NormalizeDbTime(date string) string {
+	return strings.Replace(strings.TrimSpace(date), " ", "T", 1)
+}
+
+func (t *Time) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v.UTC()
+	case string:
+		parsed, err := ParseTime(v)
+		if err != nil {
+			return err
+		}
+		t.Time = parsed
+	case []byte:
+		parsed, err := ParseTime(string(v))
+		if err != nil {
+			return err
+		}
+		t.Time = parsed
+	default:
+		return fmt.Errorf("can't scan %T into a date", src)
+	}
+	return nil
+}
+
+// Dates print the same way the database stores them (plus the zone)
+func (t Time) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+)
+
+// Just enough of the contentapi schema for uploads
+const testContentSchema = `
+CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT, avatar TEXT DEFAULT '0', createDate TEXT, super INT DEFAULT 0, password TEXT, salt TEXT, deleted INT DEFAULT 0);
+CREATE TABLE content (id INTEGER PRIMARY KEY, deleted INT DEFAULT 0, createDate TEXT, createUserId INT, name TEXT, parentId INT DEFAULT 0, contentType INT, text TEXT DEFAULT '', hash TEXT);
+CREATE TABLE content_values (id INTEGER PRIMARY KEY, contentId INT, key TEXT, value TEXT);
+CREATE TABLE content_permissions (id INTEGER PRIMARY KEY, contentId INT, userId INT, read INT);
+`
+
+// A context with the default config, pointing at an empty database and
+// uploads folder in a temp dir
+func newTestContext(t *testing.T) *GonContext {
+	dir := t.TempDir()
+	var config Config
+	err := toml.Unmarshal([]byte(GetDefaultConfig_Toml()), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Database = filepath.Join(dir, "content.db")
+	config.SidecarDatabase = filepath.Join(dir, "gontentapi.db")
+	config.Uploads = filepath.Join(dir, "uploads")
+	config.ThumbnailFolder = filepath.Join(dir, "thumbnails")
+	err = os.MkdirAll(config.Uploads, 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlx.Open("sqlite3", config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(testContentSchema)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gctx, err := NewContext(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		gctx.contentdb.Close()
+		gctx.sidecardb.Close()
+	})
+	return gctx
+}
+
+// Put a file in the uploads folder along with its content row. An empty mime
+// type isn't recorded at all
+func addTestUpload(t *testing.T, gctx *GonContext, hash string, name string, mimeType string, data []byte) {
+	err := os.WriteFile(filepath.Join(gctx.Config().Uploads, hash), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gctx.contentdb.Exec("INSERT INTO content (createDate, createUserId, name, contentType, hash) VALUES ('2020-01-01T00:00:00', 1, ?, ?, ?)",
+		name, contentapi.ContentType_File, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "" {
+		id, _ := result.LastInsertId()
+		_, err = gctx.contentdb.Exec("INSERT INTO content_values (contentId, key, value) VALUES (?, 'mimeType', ?)", id, `"`+mimeType+`"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testPng(t *testing.T, width int, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 8), G: uint8(y * 8), B: 100, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
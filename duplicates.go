@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+const (
+	DefaultDuplicateDistance = 6   // Bits (out of 64) two images can differ by and still be duplicates
+	MaxDuplicateDistance     = 20  // Past this, everything is a duplicate of everything
+	DuplicateUpdateBatch     = 100 // Most uploads hashed per update from the duplicates page
+)
+
+// Runs of characters that could be an upload hash, for finding them in text
+var uploadHashWords = regexp.MustCompile(`[a-z0-9_-]+`)
+
+type DuplicateSearch struct {
+	Distance int `schema:"distance"` // Max bits different (out of 64)
+}
+
+// What we stored about an upload the last time it was hashed
+type imageHashRow struct {
+	Hash     string        `db:"hash"`
+	Size     int64         `db:"size"`
+	Modified int64         `db:"modified"`
+	DHash    sql.NullInt64 `db:"dhash"`
+}
+
+// What UpdateImageHashes did
+type ImageHashStats struct {
+	Hashed    int // Images (re)hashed
+	NotImages int // Uploads (re)checked that aren't images we can read
+	Unchanged int // Uploads that hadn't changed since last time
+	Missing   int // Uploads with no file
+	Failed    int // Uploads that couldn't be read (logged)
+	Remaining int // New or changed uploads left for next time (over the limit)
+}
+
+// A single image in a group of duplicates
+type DuplicateImage struct {
+	Upload   contentapi.Content   // The file's own page
+	Distance int                  // Bits different from the first image in the group
+	Pages    []contentapi.Content // Every page that references it: where it was uploaded, plus any that link it
+}
+
+// Hash every image upload that's new or changed since last time (at most
+// limit of them, 0 for no limit) and forget uploads that are gone. Decoding
+// happens ThumbnailWorkers at a time, sharing the limit with thumbnail
+// generation. Progress (if given) is called after every upload
+func (gctx *GonContext) UpdateImageHashes(limit int, progress func(done int, total int)) (ImageHashStats, error) {
+	var stats ImageHashStats
+	// Only one update at a time; anyone else just waits for that one
+	err := gctx.thumbnailFlight.Do("image_hashes", func() error {
+		var err error
+		stats, err = gctx.updateImageHashes(limit, progress)
+		return err
+	})
+	return stats, err
+}
+
+func (gctx *GonContext) updateImageHashes(limit int, progress func(done int, total int)) (ImageHashStats, error) {
+	var stats ImageHashStats
+	config := gctx.Config()
+	uploads := make([]string, 0)
+	err := gctx.contentdb.Select(&uploads, "SELECT hash FROM content WHERE contentType = ? AND deleted = 0 ORDER BY id", contentapi.ContentType_File)
+	if err != nil {
+		return stats, err
+	}
+	rows := make([]imageHashRow, 0)
+	err = gctx.sidecardb.Select(&rows, "SELECT hash, size, modified, dhash FROM image_hashes")
+	if err != nil {
+		return stats, err
+	}
+	existing := make(map[string]imageHashRow, len(rows))
+	for _, row := range rows {
+		existing[row.Hash] = row
+	}
+
+	// Figure out what actually needs hashing first
+	stale := make([]imageHashRow, 0)
+	for _, hash := range uploads {
+		stat, err := os.Stat(filepath.Join(config.Uploads, hash))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return stats, err
+			}
+			stats.Missing++
+			continue
+		}
+		row := imageHashRow{Hash: hash, Size: stat.Size(), Modified: stat.ModTime().UnixNano()}
+		if old, ok := existing[hash]; ok && old.Size == row.Size && old.Modified == row.Modified {
+			stats.Unchanged++
+			delete(existing, hash)
+			continue
+		}
+		delete(existing, hash)
+		stale = append(stale, row)
+	}
+	if limit > 0 && len(stale) > limit {
+		stats.Remaining = len(stale) - limit
+		stale = stale[:limit]
+	}
+	// Anything left was deleted (or its file is gone)
+	for hash := range existing {
+		_, err = gctx.sidecardb.Exec("DELETE FROM image_hashes WHERE hash = ?", hash)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	jobs := make(chan imageHashRow)
+	type hashResult struct {
+		row imageHashRow
+		err error
+	}
+	results := make(chan hashResult)
+	var wg sync.WaitGroup
+	for range config.ThumbnailWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range jobs {
+				gctx.thumbnailWorkers.Acquire()
+				dhash, err := gctx.hashUpload(row.Hash)
+				gctx.thumbnailWorkers.Release()
+				row.DHash = dhash
+				results <- hashResult{row: row, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, row := range stale {
+			jobs <- row
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results are all written from here, sqlite only has one writer anyway
+	var failure error
+	done := 0
+	for result := range results {
+		done++
+		if progress != nil {
+			progress(done, len(stale))
+		}
+		if failure != nil {
+			continue // Let the workers finish
+		}
+		if result.err != nil {
+			log.Printf("WARN: couldn't hash upload %s: %s", result.row.Hash, result.err)
+			stats.Failed++
+			continue
+		}
+		row := result.row
+		_, failure = gctx.sidecardb.Exec("INSERT OR REPLACE INTO image_hashes(hash, size, modified, dhash, updateDate) VALUES (?,?,?,?,?)",
+			row.Hash, row.Size, row.Modified, row.DHash, time.Now().UTC().Format(time.RFC3339))
+		if failure != nil {
+			continue
+		}
+		if row.DHash.Valid {
+			stats.Hashed++
+		} else {
+			stats.NotImages++
+		}
+	}
+	return stats, failure
+}
+
+// The dhash of a single upload, or null if it isn't an image we can read
+func (gctx *GonContext) hashUpload(imgslug string) (sql.NullInt64, error) {
+	file, err := os.Open(filepath.Join(gctx.Config().Uploads, imgslug))
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	defer file.Close()
+	img, format, err := utils.DecodeImageLimited(file, int64(gctx.Config().ThumbnailMaxPixels))
+	if err != nil {
+		var badRequest *utils.BadRequest
+		if errors.As(err, &badRequest) {
+			return sql.NullInt64{}, nil
+		}
+		return sql.NullInt64{}, err
+	}
+	// Hash what people see, so a rotated re-upload still matches
+	if format == "jpeg" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return sql.NullInt64{}, err
+		}
+		img = utils.Orient(img, utils.JpegOrientation(file))
+	}
+	// Sqlite only has signed integers, the bits are all that matter
+	return sql.NullInt64{Int64: int64(utils.DHash(img)), Valid: true}, nil
+}
+
+// Group the hashed uploads that are within maxDistance bits of each other,
+// along with every page that references them. Uses whatever hashes are stored,
+// so update them first
+func (gctx *GonContext) FindDuplicates(maxDistance int) ([][]DuplicateImage, error) {
+	rows := make([]imageHashRow, 0)
+	err := gctx.sidecardb.Select(&rows, "SELECT hash, size, modified, dhash FROM image_hashes WHERE dhash IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	dhashes := make(map[string]uint64, len(rows))
+	for _, row := range rows {
+		dhashes[row.Hash] = uint64(row.DHash.Int64)
+	}
+	// Oldest uploads first, so each group starts with the original (probably)
+	files := make([]contentapi.Content, 0)
+	err = gctx.contentdb.Select(&files, "SELECT "+contentapi.GetContentFields("c", false)+" FROM content c "+
+		"WHERE c.contentType = ? AND c.deleted = 0 ORDER BY c.id", contentapi.ContentType_File)
+	if err != nil {
+		return nil, err
+	}
+	hashed := make([]contentapi.Content, 0, len(rows))
+	values := make([]uint64, 0, len(rows))
+	for _, f := range files {
+		if dhash, ok := dhashes[f.Hash]; ok {
+			hashed = append(hashed, f)
+			values = append(values, dhash)
+		}
+	}
+
+	grouped := utils.GroupSimilar(values, maxDistance)
+	uploads := make([]contentapi.Content, 0)
+	for _, members := range grouped {
+		for _, i := range members {
+			uploads = append(uploads, hashed[i])
+		}
+	}
+	references, err := gctx.GetUploadReferences(uploads)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([][]DuplicateImage, 0, len(grouped))
+	for _, members := range grouped {
+		group := make([]DuplicateImage, 0, len(members))
+		for _, i := range members {
+			group = append(group, DuplicateImage{
+				Upload:   hashed[i],
+				Distance: utils.HashDistance(values[members[0]], values[i]),
+				Pages:    references[hashed[i].Hash],
+			})
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// Every page that references each of the given uploads, by hash: the one it
+// was uploaded to, plus any whose text has the hash in it (on its own, not as
+// part of another word). This is one pass over the content however many
+// uploads there are. No permission checks, this is for super users
+func (gctx *GonContext) GetUploadReferences(uploads []contentapi.Content) (map[string][]contentapi.Content, error) {
+	references := make(map[string][]contentapi.Content, len(uploads))
+	parents := make(map[int64][]string)
+	for _, upload := range uploads {
+		references[upload.Hash] = make([]contentapi.Content, 0)
+		parents[upload.ParentId] = append(parents[upload.ParentId], upload.Hash)
+	}
+	if len(uploads) == 0 {
+		return references, nil
+	}
+	// Text can be huge, so only one page at a time
+	rows, err := gctx.contentdb.Queryx("SELECT "+contentapi.GetContentFields("c", true)+" FROM content c "+
+		"WHERE c.deleted = 0 AND c.contentType <> ? ORDER BY c.id", contentapi.ContentType_File)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var page contentapi.Content
+		err = rows.StructScan(&page)
+		if err != nil {
+			return nil, err
+		}
+		linked := make(map[string]bool)
+		for _, hash := range parents[page.Id] {
+			linked[hash] = true
+		}
+		for _, word := range uploadHashWords.FindAllString(page.Text, -1) {
+			if _, ok := references[word]; ok {
+				linked[word] = true
+			}
+		}
+		page.Text = "" // Nobody needs this
+		for hash := range linked {
+			references[hash] = append(references[hash], page)
+		}
+	}
+	return references, rows.Err()
+}
+
+// Hash the next DuplicateUpdateBatch new or changed uploads for the
+// duplicates page, for super users only. Hashing everything the first time
+// can take a while, so that's better done with the command
+func (gctx *GonContext) AddDuplicateHashUpdate(user *UserSession, data map[string]any) error {
+	err := gctx.RequireSuper(user)
+	if err != nil {
+		return err
+	}
+	stats, err := gctx.UpdateImageHashes(DuplicateUpdateBatch, nil)
+	if err != nil {
+		return err
+	}
+	data["hashstats"] = stats
+	return nil
+}
+
+// The duplicate images page, for super users only. Only uses the hashes that
+// are already stored (see AddDuplicateHashUpdate)
+func (gctx *GonContext) AddDuplicatesData(search *DuplicateSearch, user *UserSession, data map[string]any) error {
+	err := gctx.RequireSuper(user)
+	if err != nil {
+		return err
+	}
+	if search.Distance < 0 || search.Distance > MaxDuplicateDistance {
+		return &utils.BadRequest{Message: fmt.Sprintf("Distance must be between 0 and %d", MaxDuplicateDistance)}
+	}
+	var hashed int
+	err = gctx.sidecardb.Get(&hashed, "SELECT COUNT(*) FROM image_hashes WHERE dhash IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	groups, err := gctx.FindDuplicates(search.Distance)
+	if err != nil {
+		return err
+	}
+	data["title"] = "Duplicate images"
+	data["search"] = search
+	data["hashed"] = hashed
+	data["groups"] = groups
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+)
+
+func addTestPage(t *testing.T, gctx *GonContext, name string, text string, deleted bool) int64 {
+	result, err := gctx.contentdb.Exec("INSERT INTO content (createDate, createUserId, name, contentType, text, hash, deleted) VALUES ('2020-01-01T00:00:00', 1, ?, ?, ?, ?, ?)",
+		name, contentapi.ContentType_Page, text, name, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+func TestUpdateImageHashesBatch(t *testing.T) {
+	gctx := newTestContext(t)
+	for _, hash := range []string{"one", "two", "three"} {
+		addTestUpload(t, gctx, hash, hash+".png", "image/png", testPng(t, 20, 20))
+	}
+	stats, err := gctx.UpdateImageHashes(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hashed != 2 || stats.Remaining != 1 {
+		t.Fatalf("Expected 2 hashed and 1 left, got %+v", stats)
+	}
+	stats, err = gctx.UpdateImageHashes(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hashed != 1 || stats.Unchanged != 2 || stats.Remaining != 0 {
+		t.Fatalf("Expected the last one hashed, got %+v", stats)
+	}
+}
+
+func TestFindDuplicatesReferences(t *testing.T) {
+	gctx := newTestContext(t)
+	gallery := addTestPage(t, gctx, "gallery", "", false)
+	addTestPage(t, gctx, "linker", "see [img=abc-1] and also (abc-10)", false)
+	addTestPage(t, gctx, "lookalike", "xabc-1 abc-1x abc-1_", false)
+	addTestPage(t, gctx, "gone", "abc-1", true)
+	addTestUpload(t, gctx, "abc-1", "first.png", "image/png", testPng(t, 20, 20))
+	addTestUpload(t, gctx, "abc-10", "second.png", "image/png", testPng(t, 20, 20))
+	_, err := gctx.contentdb.Exec("UPDATE content SET parentId = ? WHERE hash = 'abc-1'", gallery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gctx.UpdateImageHashes(0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := gctx.FindDuplicates(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0]) != 2 {
+		t.Fatalf("Expected one group of two, got %v", groups)
+	}
+	pageNames := func(image DuplicateImage) []string {
+		names := make([]string, 0)
+		for _, p := range image.Pages {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+	// Pages come in id order, only with the hash on its own
+	if names := pageNames(groups[0][0]); len(names) != 2 || names[0] != "gallery" || names[1] != "linker" {
+		t.Fatalf("Expected abc-1 in gallery and linker, got %v", names)
+	}
+	if names := pageNames(groups[0][1]); len(names) != 1 || names[0] != "linker" {
+		t.Fatalf("Expected abc-10 in linker, got %v", names)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"golang.org/x/crypto/pbkdf2"
 	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -40,14 +41,25 @@ type UserSession struct {
 }
 
 type GonContext struct {
-	config        *Config
-	decoder       *schema.Decoder
-	templates     *template.Template
-	sessions      map[string]*UserSession
-	sessionLock   sync.Mutex
-	thumbnailLock sync.Mutex
-	created       time.Time
-	contentdb     *sqlx.DB
+	config            *Config                       // Use Config(), this can be swapped on reload
+	templates         map[string]*template.Template // Templates per theme. Use Templates(), this can be swapped on reload
+	themes            []string                      // Names of all loaded themes (sorted)
+	cachebust         string                        // Use CacheBust(), changes when the static files do
+	reloadLock        sync.RWMutex
+	staticfs          fs.FS // Static files on disk layered over the built-in ones
+	themefs           fs.FS // Theme folders on disk layered over the built-in ones
+	decoder           *schema.Decoder
+	sessions          map[string]*UserSession
+	sessionLock       sync.Mutex
+	thumbnailFlight   utils.FlightGroup // One generation per thumbnail at a time
+	thumbnailWorkers  utils.Limiter     // How many thumbnails can generate at once
+	thumbnailFailures sync.Map          // Uploads that couldn't be thumbnailed recently (see thumbnails.go)
+	thumbnailCache    *utils.DiskLRU    // Keeps the thumbnail folder under ThumbnailCacheLimit
+	diffWorkers       utils.Limiter     // How many diffs can run at once (they can be big)
+	created           time.Time
+	contentdb         *sqlx.DB
+	sidecardb         *sqlx.DB // Our own database, see sidecar.go
+	staticExport      bool     // Rendering for the static export (no forms, no dynamic links)
 	//chatlogIncludeRegex *regexp.Regexp
 }
 
@@ -61,23 +73,19 @@ func NewContext(config *Config) (*GonContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	thumbnailCache, err := utils.NewDiskLRU(config.ThumbnailFolder, config.ThumbnailCacheBytes(), ThumbnailTempPattern)
+	if err != nil {
+		return nil, err
+	}
 
-	// We initialize the templates first because we don't really need
-	// hot reloading (also it's just better for performance... though memory usage...
-	templates, err := template.New("alltemplates").Funcs(template.FuncMap{
-		"RawHtml":      func(c string) template.HTML { return template.HTML(c) },
-		"RawUrl":       func(c string) template.URL { return template.URL(c) },
-		"UploadUrl":    func(c string) string { return fmt.Sprintf("%s/uploads/%s", config.RootPath, c) },
-		"ThumbnailUrl": func(c string) string { return fmt.Sprintf("%s/thumbnails/%s", config.RootPath, c) },
-		"PageUrl": func(c *contentapi.Content) string {
-			url := config.RootPath + "/pages"
-			if c.Id != 0 { // The root page (or otherwise). DON'T check hash: we WANT it to fail if hash empty
-				url += "/" + c.Hash
-			}
-			return url
-		},
-	}).ParseGlob(filepath.Join(config.Templates, "*.tmpl"))
+	templates, themes, err := ParseThemes(config)
+	if err != nil {
+		return nil, err
+	}
 
+	staticfs := StaticFS(config)
+	themefs := ThemeFS(config)
+	cachebust, err := utils.HashFS(staticfs, themefs)
 	if err != nil {
 		return nil, err
 	}
@@ -87,6 +95,15 @@ func NewContext(config *Config) (*GonContext, error) {
 		return nil, err
 	}
 
+	err = os.MkdirAll(filepath.Dir(config.SidecarDatabase), 0750)
+	if err != nil {
+		return nil, err
+	}
+	sidecardb, err := OpenSidecar(config.SidecarDatabase)
+	if err != nil {
+		return nil, err
+	}
+
 	decoder := schema.NewDecoder()
 	decoder.IgnoreUnknownKeys(true)
 
@@ -94,15 +111,77 @@ func NewContext(config *Config) (*GonContext, error) {
 	return &GonContext{
 		config:    config,
 		templates: templates,
+		themes:    themes,
+		staticfs:  staticfs,
+		themefs:   themefs,
+		cachebust: cachebust,
 		decoder:   decoder,
 		created:   time.Now(),
 		contentdb: contentdb,
+		sidecardb: sidecardb,
 		sessions:  make(map[string]*UserSession),
+
+		thumbnailWorkers: utils.NewLimiter(config.ThumbnailWorkers),
+		diffWorkers:      utils.NewLimiter(MaxConcurrentDiffs),
+		thumbnailCache:   thumbnailCache,
 	}, nil
 }
 
+// Parse all the templates in the given filesystem for the given config. This is
+// done for every theme on startup and again on every reload
+func ParseTemplates(config *Config, fsys fs.FS) (*template.Template, error) {
+	return template.New("alltemplates").Funcs(template.FuncMap{
+		"RawHtml":         func(c string) template.HTML { return template.HTML(c) },
+		"RawUrl":          func(c string) template.URL { return template.URL(c) },
+		"UploadUrl":       func(c string) string { return fmt.Sprintf("%s/uploads/%s", config.RootPath, c) },
+		"ThumbnailUrl":    func(c string) string { return fmt.Sprintf("%s/thumbnails/%s", config.RootPath, c) },
+		"ThumbnailSrcset": func(c string) string { return ThumbnailSrcset(config, c) },
+		"AvatarUrl":       func(who any) string { return AvatarUrl(config, who) },
+		"AvatarSrcset":    func(who any) string { return AvatarSrcset(config, who) },
+		"ClockTime":       ClockTime,
+		"IsoDate":         IsoDate,
+		"RelativeDate":    RelativeDate,
+		"FormatBytes":     utils.FormatBytes,
+		"PageUrl": func(c *contentapi.Content) string {
+			url := config.RootPath + "/pages"
+			if c.Id != 0 { // The root page (or otherwise). DON'T check hash: we WANT it to fail if hash empty
+				url += "/" + c.Hash
+			}
+			return url
+		},
+	}).ParseFS(fsys, "*.tmpl")
+}
+
+// The current config. Don't hold onto this too long, it's replaced on reload
+func (gctx *GonContext) Config() *Config {
+	gctx.reloadLock.RLock()
+	defer gctx.reloadLock.RUnlock()
+	return gctx.config
+}
+
+// The current templates for the given theme (the default theme if it doesn't
+// exist). Don't hold onto this too long, it's replaced on reload
+func (gctx *GonContext) Templates(theme string) *template.Template {
+	gctx.reloadLock.RLock()
+	defer gctx.reloadLock.RUnlock()
+	if t, ok := gctx.templates[theme]; ok {
+		return t
+	}
+	if t, ok := gctx.templates[gctx.config.DefaultTheme]; ok {
+		return t
+	}
+	return gctx.templates[DefaultThemeName]
+}
+
+// A value for static urls that only changes when the static files do
+func (gctx *GonContext) CacheBust() string {
+	gctx.reloadLock.RLock()
+	defer gctx.reloadLock.RUnlock()
+	return gctx.cachebust
+}
+
 func (gctx *GonContext) IsExpired(user *UserSession) bool {
-	return time.Now().After(user.Created.Add(time.Duration(gctx.config.LoginExpire)))
+	return time.Now().After(user.Created.Add(time.Duration(gctx.Config().LoginExpire)))
 }
 
 // Return the current user session if it exists, otherwise return nil. There are
@@ -110,7 +189,7 @@ func (gctx *GonContext) IsExpired(user *UserSession) bool {
 // cookie is expired. the only time something is invalid is if something went
 // wrong RETRIEVING the cookie, which is very unlikely (and we just log it)
 func (gctx *GonContext) GetCurrentUser(r *http.Request) *UserSession {
-	cookie, err := r.Cookie(gctx.config.LoginCookie)
+	cookie, err := r.Cookie(gctx.Config().LoginCookie)
 	if err != nil {
 		if err != http.ErrNoCookie {
 			log.Printf("Cookie error: %s", err)
@@ -131,22 +210,32 @@ func (gctx *GonContext) GetCurrentUser(r *http.Request) *UserSession {
 func (gctx *GonContext) GetDefaultData(r *http.Request, user *UserSession) map[string]any {
 	rinfo := utils.GetRuntimeInfo()
 	result := make(map[string]any)
-	result["root"] = template.URL(gctx.config.RootPath)
+	result["root"] = template.URL(gctx.Config().RootPath)
 	result["appversion"] = Version
 	result["runtimeInfo"] = rinfo
-	result["requestUri"] = gctx.config.RootPath + r.URL.RequestURI()
-	result["cachebust"] = gctx.created.Format(time.RFC3339)
+	result["requestUri"] = gctx.Config().RootPath + r.URL.RequestURI()
+	result["cachebust"] = gctx.CacheBust()
+	result["theme"] = gctx.GetTheme(r)
+	result["themes"] = gctx.ThemeNames()
+	result["prefs"] = gctx.GetPreferences(r, user)
 	result["title"] = "Gontentapi"
 	if user != nil {
 		result["user"] = user
 		result["loggedin"] = true
 	}
+	if gctx.staticExport {
+		result["staticexport"] = true
+	}
 	return result
 }
 
 // Call this instead of directly accessing templates to do a final render of a page
 func (gctx *GonContext) RunTemplate(name string, w http.ResponseWriter, data any) {
-	err := gctx.templates.ExecuteTemplate(w, name, data)
+	var theme string
+	if m, ok := data.(map[string]any); ok {
+		theme, _ = m["theme"].(string)
+	}
+	err := gctx.Templates(theme).ExecuteTemplate(w, name, data)
 	if err != nil {
 		log.Printf("ERROR: can't load template: %s", err)
 		http.Error(w, "Template load error (internal server error!)", http.StatusInternalServerError)
@@ -219,13 +308,36 @@ func (gctx *GonContext) AddSession(user *UserSession) (string, error) {
 		log.Printf("Removed %d old sessions", removed)
 	}
 	// If sessions is still too large, just reject it
-	if len(gctx.sessions) >= gctx.config.MaxSessions {
-		return "", fmt.Errorf("Too many sessions: %d", gctx.config.MaxSessions) // This is an unexpected error
+	if len(gctx.sessions) >= gctx.Config().MaxSessions {
+		return "", fmt.Errorf("Too many sessions: %d", gctx.Config().MaxSessions) // This is an unexpected error
 	}
 	gctx.sessions[sessid] = user
 	return sessid, nil
 }
 
+// Just the time of day (hh:mm:ss) of a database date, in UTC. The archive
+// days are UTC too, so this is always labeled as UTC rather than shown in the
+// viewer's zone (where it could land on a different day)
+func ClockTime(date contentapi.Time) string {
+	return date.UTC().Format("15:04:05")
+}
+
+// A database date in a machine readable format, for <time datetime="">
+func IsoDate(date contentapi.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.UTC().Format(time.RFC3339)
+}
+
+// How long ago a database date was, ex "3 days ago"
+func RelativeDate(date contentapi.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return utils.RelativeTime(date.Time, time.Now())
+}
+
 func MakeRoot(c *contentapi.Content) *contentapi.Content {
 	if c == nil {
 		c = &contentapi.Content{}
@@ -254,3 +366,40 @@ func (gctx *GonContext) GetUsers(uids ...int64) ([]contentapi.User, error) {
 
 	return users, nil
 }
+
+// Make sure the given user is a super user (according to the database, not
+// the session, so it's up to date)
+func (gctx *GonContext) RequireSuper(user *UserSession) error {
+	if user == nil {
+		return &utils.Forbidden{Message: "You must be logged in"}
+	}
+	users, err := gctx.GetUsers(user.Uid)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 || !users[0].Super {
+		return &utils.Forbidden{Message: "Only super users can do that"}
+	}
+	return nil
+}
+
+// Retrieve all message values for the given message ids in one query
+func (gctx *GonContext) GetMessageValues(mids ...int64) ([]contentapi.MessageValue, error) {
+	values := make([]contentapi.MessageValue, 0)
+	if len(mids) == 0 {
+		return values, nil
+	}
+
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT " + contentapi.GetMessageValueFields("") + " FROM message_values WHERE messageId IN ("
+	q.AddQueryParams(utils.UniqueParams(mids...)...)
+	q.Sql += ")"
+	q.Finalize()
+
+	err := gctx.contentdb.Select(&values, q.Sql, q.Params...)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
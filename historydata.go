@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+// Diffs running at the same time; the rest wait
+const MaxConcurrentDiffs = 4
+
+type DiffSearch struct {
+	From  int64 `schema:"from"`  // Revision to diff from (0 means empty)
+	To    int64 `schema:"to"`    // Revision to diff to (0 means current text)
+	Words bool  `schema:"words"` // Diff by words instead of lines
+}
+
+// Retrieve a single revision (with snapshot) for the given page. The page
+// must already have been checked for permissions
+func (gctx *GonContext) GetRevision(page *contentapi.Content, rid int64) (*contentapi.ContentHistory, *contentapi.ContentSnapshot, error) {
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT " + contentapi.GetHistoryFields("h", true) + " FROM content_history h WHERE h.contentId = ? AND h.id = ?"
+	q.AddParams(page.Id, rid)
+	q.Finalize()
+
+	var revision contentapi.ContentHistory
+	err := gctx.contentdb.Get(&revision, q.Sql, q.Params...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, &utils.NotFound{Message: fmt.Sprintf("No revision %d for %s", rid, page.Hash)}
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	snapshot, err := contentapi.ParseSnapshot(revision.Snapshot)
+	if err != nil {
+		log.Printf("WARN: couldn't parse snapshot for revision %d: %s", rid, err)
+		return nil, nil, &utils.BadRequest{Message: fmt.Sprintf("Revision %d has an unreadable snapshot", rid)}
+	}
+
+	return &revision, snapshot, nil
+}
+
+// Apply users to the given revisions. It's fine if they don't exist
+func (gctx *GonContext) applyHistoryUsers(revisions ...*contentapi.ContentHistory) error {
+	uids := make([]int64, len(revisions))
+	for i := range revisions {
+		uids[i] = revisions[i].CreateUserId
+	}
+	users, err := gctx.GetUsers(uids...)
+	if err != nil {
+		return err
+	}
+	usermap := contentapi.GetMappedUsers(users)
+	for _, r := range revisions {
+		if r.ApplyUser(usermap) == nil {
+			log.Printf("WARN: couldn't find user for revision %d", r.Id)
+		}
+	}
+	return nil
+}
+
+// Add the list of revisions for the given page
+func (gctx *GonContext) AddHistoryData(hash string, user *UserSession, data map[string]any) error {
+	var uid int64
+	if user != nil {
+		uid = int64(user.Uid)
+	}
+
+	mainpage, err := gctx.GetViewablePage(hash, uid, false)
+	if err != nil {
+		return err
+	}
+
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT " + contentapi.GetHistoryFields("h", false) + " FROM content_history h WHERE h.contentId = ?"
+	q.AddParams(mainpage.Id)
+	q.Order = "h.id DESC"
+	q.Finalize()
+
+	history := make([]contentapi.ContentHistory, 0)
+	err = gctx.contentdb.Select(&history, q.Sql, q.Params...)
+	if err != nil {
+		return err
+	}
+
+	// Ordered newest first, so the previous revision is the next one in the list
+	revisions := make([]*contentapi.ContentHistory, len(history))
+	for i := range history {
+		if i < len(history)-1 {
+			history[i].PreviousId = history[i+1].Id
+		}
+		revisions[i] = &history[i]
+	}
+
+	err = gctx.applyHistoryUsers(revisions...)
+	if err != nil {
+		return err
+	}
+
+	data["title"] = mainpage.Name + " (history)"
+	data["mainpage"] = mainpage
+	data["history"] = history
+
+	return nil
+}
+
+// Add a single historic snapshot of a page
+func (gctx *GonContext) AddRevisionData(hash string, rid int64, user *UserSession, data map[string]any) error {
+	var uid int64
+	if user != nil {
+		uid = int64(user.Uid)
+	}
+
+	mainpage, err := gctx.GetViewablePage(hash, uid, false)
+	if err != nil {
+		return err
+	}
+
+	revision, snapshot, err := gctx.GetRevision(mainpage, rid)
+	if err != nil {
+		return err
+	}
+
+	err = gctx.applyHistoryUsers(revision)
+	if err != nil {
+		return err
+	}
+
+	data["title"] = fmt.Sprintf("%s (revision %d)", mainpage.Name, rid)
+	data["mainpage"] = mainpage
+	data["revision"] = revision
+	data["snapshot"] = snapshot
+
+	return nil
+}
+
+// Add the diff between two revisions of a page
+func (gctx *GonContext) AddDiffData(hash string, search *DiffSearch, user *UserSession, data map[string]any) error {
+	var uid int64
+	if user != nil {
+		uid = int64(user.Uid)
+	}
+
+	mainpage, err := gctx.GetViewablePage(hash, uid, true)
+	if err != nil {
+		return err
+	}
+
+	var fromText, toText string
+
+	if search.From != 0 {
+		revision, snapshot, err := gctx.GetRevision(mainpage, search.From)
+		if err != nil {
+			return err
+		}
+		fromText = snapshot.Text
+		data["fromrevision"] = revision
+	}
+
+	if search.To != 0 {
+		revision, snapshot, err := gctx.GetRevision(mainpage, search.To)
+		if err != nil {
+			return err
+		}
+		toText = snapshot.Text
+		data["torevision"] = revision
+	} else {
+		toText = mainpage.Text
+	}
+
+	// Each diff can take a good chunk of memory, so only a few at once
+	gctx.diffWorkers.Acquire()
+	defer gctx.diffWorkers.Release()
+	var diff []utils.DiffPart
+	if search.Words {
+		diff = utils.DiffWords(fromText, toText)
+	} else {
+		diff = utils.DiffLines(fromText, toText)
+	}
+
+	data["title"] = mainpage.Name + " (diff)"
+	data["mainpage"] = mainpage
+	data["search"] = search
+	data["diff"] = diff
+
+	return nil
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"slices"
+	"strings"
 	//"sync"
 	"syscall"
 	"time"
@@ -21,31 +25,45 @@ import (
 	"github.com/randomouscrap98/gontentapi/utils"
 )
 
-const (
-	ConfigFile = "config.toml"
-)
-
-func must(err error) {
+// Load the config stack starting at the given file. The base config must
+// exist; we don't generate it anymore (use 'config init'). Unknown keys don't
+// stop the load, they're returned as problems (with a suggestion if possible)
+func loadConfig(configFile string) (*Config, []string, []string, error) {
+	// The defaults go underneath everything, so older configs get sensible
+	// values for fields added since they were generated
+	var config Config
+	err := toml.Unmarshal([]byte(GetDefaultConfig_Toml()), &config)
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, err
 	}
-}
-
-func initConfig() *Config {
-	var config Config
-	results, err := utils.ReadConfigStack(ConfigFile, func(_ string, raw []byte) error {
-		return toml.Unmarshal(raw, &config)
+	problems := make([]string, 0)
+	fields := utils.ConfigFieldNames(&config)
+	results, err := utils.ReadConfigStack(configFile, func(name string, raw []byte) error {
+		decoder := toml.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&config)
+		var strict *toml.StrictMissingError
+		if errors.As(err, &strict) {
+			for _, missing := range strict.Errors {
+				key := strings.Join(missing.Key(), ".")
+				row, _ := missing.Position()
+				problem := fmt.Sprintf("%s:%d: unknown key %s", name, row, key)
+				if suggestion := utils.ClosestMatch(key, fields); suggestion != "" {
+					problem += fmt.Sprintf(" (did you mean %s?)", suggestion)
+				}
+				problems = append(problems, problem)
+			}
+			return nil
+		}
+		return err
 	}, 10)
-	must(err)
-	// This means the original config wasn't loaded; let's load it and try again
-	if slices.Index(results, ConfigFile) < 0 {
-		configRaw := GetDefaultConfig_Toml()
-		must(os.WriteFile(ConfigFile, []byte(configRaw), 0600))
-		log.Printf("Generated default config at %s\n", ConfigFile)
-		return initConfig() // Redo the configs (it's fine...?)
+	if err != nil {
+		return nil, results, problems, err
+	}
+	if slices.Index(results, configFile) < 0 {
+		return nil, results, problems, fmt.Errorf("config %s not found (run 'gontentapi config init' to create one)", configFile)
 	}
-	log.Printf("Loaded %d config(s)", len(results))
-	return &config
+	return &config, results, problems, nil
 }
 
 func initRouter(config *Config) *chi.Mux {
@@ -88,22 +106,47 @@ func waitForSigterm() {
 	<-sigChan
 }
 
-func main() {
-	log.Printf("Gontentapi server started\n")
-	config := initConfig()
+// The serve command: run the http server until we get a signal
+func runServe(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	dev := flags.Bool("dev", false, "Development mode: reload templates as soon as they change on disk")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = noExtraArgs(flags); err != nil {
+		return err
+	}
 
-	gctx, err := NewContext(config)
-	must(err)
+	log.Printf("Gontentapi server started\n")
+	config, gctx, err := cli.LoadContext()
+	if err != nil {
+		return err
+	}
+	// Only the server cleans up; commands can run alongside it
+	err = CleanThumbnailTemps(config.ThumbnailFolder, ThumbnailTempMaxAge)
+	if err != nil {
+		return err
+	}
 
 	// Context is something we'll cancel to cancel any and all background tasks
 	// when the server gets a shutdown signal. This for some reason does not
 	// include the server itself...
-	// _, cancel := context.WithCancel(context.Background())
-	// defer cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// SIGHUP reloads the config and templates without dropping sessions
+	go handleReloads(ctx, cli, gctx)
+	if *dev {
+		log.Printf("Dev mode: watching %s for template changes", config.Templates)
+		go watchTemplates(ctx, gctx, time.Second)
+	}
 
 	r := initRouter(config)
 	err = SetupRoutes(r, gctx)
-	must(err)
+	if err != nil {
+		return err
+	}
 
 	// var wg sync.WaitGroup
 
@@ -115,15 +158,12 @@ func main() {
 	// service.RunBackground(ctx, &wg)
 	// log.Printf("Mounted '%s' at %s", service.GetIdentifier(), k)
 
-	// --- Static files -----
-	//must(err)
-
 	// --- Server ---
 	s := runServer(r, config)
 	waitForSigterm()
 
 	log.Println("Shutting down...")
-	//cancel() // Cancel the context to signal goroutines to stop
+	cancel() // Cancel the context to signal goroutines to stop
 	//wg.Wait()
 	log.Println("All background services stopped")
 
@@ -133,8 +173,13 @@ func main() {
 
 	// Shut down the server gracefully
 	if err := s.Shutdown(ctxShutdown); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+		return fmt.Errorf("server shutdown failed: %w", err)
 	}
 
 	log.Println("Server stopped")
+	return nil
+}
+
+func main() {
+	os.Exit(RunCli(os.Args[1:]))
 }
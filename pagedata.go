@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"slices"
+	"time"
 
 	"github.com/randomouscrap98/gontentapi/contentapi"
 	"github.com/randomouscrap98/gontentapi/utils"
@@ -49,18 +50,56 @@ func (search *Search) MakeInitialQuery(fields string, uid int64) contentapi.Quer
 }
 
 type CommentSearch struct {
-	Search string `schema:"search"`
-	User   int64  `schema:"user"`
-	Page   int    `schema:"page"`
-	Start  string `schema:"start"`
-	Oldest bool   `schema:"oldest"`
+	Search    string `schema:"search"`
+	User      int64  `schema:"user"`
+	Page      int    `schema:"page"`
+	Start     string `schema:"start"`     // A date or datetime, in the viewer's time zone
+	End       string `schema:"end"`       // Same as start; a plain date includes that whole day
+	Order     string `schema:"order"`     // newest or oldest. Empty means the user's preference
+	Oldest    bool   `schema:"oldest"`    // Older links used this instead of order
+	NoModules bool   `schema:"nomodules"` // Hide module messages (dice, bots, etc)
+
+	// Start and end, parsed and converted to database dates
+	startDate string
+	endDate   string
+}
+
+// Parse the start and end bounds, which are in the given time zone unless they say otherwise
+func (search *CommentSearch) ParseDates(loc *time.Location) error {
+	var err error
+	search.startDate, search.endDate, err = parseDateBounds(search.Start, search.End, loc)
+	return err
+}
+
+// Parse a start and end date given by a user (see utils.ParseUserTime) into
+// database dates. A plain end date includes that whole day. Empty bounds stay empty
+func parseDateBounds(startRaw string, endRaw string, loc *time.Location) (string, string, error) {
+	var startDate, endDate string
+	if startRaw != "" {
+		start, _, err := utils.ParseUserTime(startRaw, loc)
+		if err != nil {
+			return "", "", err
+		}
+		startDate = contentapi.FormatDbTime(start)
+	}
+	if endRaw != "" {
+		end, dateOnly, err := utils.ParseUserTime(endRaw, loc)
+		if err != nil {
+			return "", "", err
+		}
+		if dateOnly {
+			end = end.AddDate(0, 0, 1)
+		}
+		endDate = contentapi.FormatDbTime(end)
+	}
+	return startDate, endDate, nil
 }
 
 func (search *CommentSearch) MakeInitialQuery(fields string, contentId int64, uid int64) contentapi.Query {
 	q := contentapi.NewQuery()
 	q.Sql = "SELECT " + fields + " FROM messages m WHERE m.contentId = ?"
 	q.AddParams(contentId)
-	q.AndCommentViewable("m")
+	q.AndCommentViewable("m", uid, !search.NoModules)
 	if search.Search != "" {
 		// This should get more complicated later
 		searchAny := "%" + search.Search + "%"
@@ -72,16 +111,39 @@ func (search *CommentSearch) MakeInitialQuery(fields string, contentId int64, ui
 		q.Sql += " AND m.createUserId = ?"
 		q.AddParams(search.User)
 	}
-	if search.Start != "" {
-		q.Sql += " AND m.createDate > ?"
-		q.AddParams(search.Start)
+	if search.startDate != "" {
+		q.AndTimeAtLeast("m.createDate", search.startDate)
+	}
+	if search.endDate != "" {
+		q.AndTimeBefore("m.createDate", search.endDate)
 	}
 	//q.AddParams(mainpage.Id, contentapi.ContentType_File)
 	q.AndViewable("m.contentId", uid)
 	return q
 }
 
-func (gctx *GonContext) AddSearchResults(search *Search, user *UserSession, data map[string]any) error {
+// Lookup a single page by hash, but only if the given user can view it
+func (gctx *GonContext) GetViewablePage(hash string, uid int64, allFields bool) (*contentapi.Content, error) {
+	var page contentapi.Content
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT " + contentapi.GetContentFields("c", allFields) + " FROM content c WHERE c.hash = ?"
+	q.AddParams(hash)
+	q.AndViewable("c.id", uid)
+	q.Finalize()
+	err := gctx.contentdb.Get(&page, q.Sql, q.Params...)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &utils.NotFound{Message: fmt.Sprintf("No content with hash %s", hash)}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &page, nil
+}
+
+func (gctx *GonContext) AddSearchResults(search *Search, user *UserSession, prefs *Preferences, data map[string]any) error {
 	// doing too much here?
 	ignoretypes := make(map[string]IgnoreTypeData)
 	addignoretype := func(name string, value int) {
@@ -111,11 +173,11 @@ func (gctx *GonContext) AddSearchResults(search *Search, user *UserSession, data
 		return err
 	}
 
-	skip := gctx.config.CommentsPerPage * search.Page
+	skip := prefs.CommentsPerPage * search.Page
 
 	q = search.MakeInitialQuery(contentapi.GetContentFields("c", false), uid)
 	q.Order = "c.id DESC"
-	q.Limit = gctx.config.CommentsPerPage // Sure, why not
+	q.Limit = prefs.CommentsPerPage // Sure, why not
 	q.Skip = skip
 	q.Finalize()
 
@@ -138,50 +200,48 @@ func (gctx *GonContext) AddSearchResults(search *Search, user *UserSession, data
 	return nil
 }
 
-func (gctx *GonContext) AddCommentData(hash string, search *CommentSearch, user *UserSession, data map[string]any) ([]contentapi.Comment, error) {
+func (gctx *GonContext) AddCommentData(hash string, search *CommentSearch, user *UserSession, prefs *Preferences, data map[string]any) ([]contentapi.Comment, error) {
 	var uid int64
 	if user != nil {
 		uid = int64(user.Uid)
 	}
 
-	var mainpage contentapi.Content
-
 	// Still need to lookup main page to make sure they have access to it
 	if hash == "" {
 		return nil, &utils.BadRequest{Message: "Must specify a page hash to view comments!"}
-	} else {
-		q := contentapi.NewQuery()
-		q.Sql = "SELECT " + contentapi.GetContentFields("c", false) + " FROM content c WHERE c.hash = ?"
-		q.AddParams(hash)
-		q.AndViewable("c.id", uid)
-		q.Finalize()
-		err := gctx.contentdb.Get(&mainpage, q.Sql, q.Params...)
+	}
+	mainpage, err := gctx.GetViewablePage(hash, uid, false)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			if err == sql.ErrNoRows {
-				return nil, &utils.NotFound{Message: fmt.Sprintf("No content with hash %s", hash)}
-			} else {
-				return nil, err
-			}
-		}
+	err = search.ParseDates(prefs.Location())
+	if err != nil {
+		return nil, err
 	}
 
 	// Get count of "search" results
 	q := search.MakeInitialQuery("COUNT(*)", mainpage.Id, uid)
 	var count int64
-	err := gctx.contentdb.Get(&count, q.Sql, q.Params...)
+	err = gctx.contentdb.Get(&count, q.Sql, q.Params...)
 	if err != nil {
 		return nil, err
 	}
 
-	skip := gctx.config.CommentsPerPage * search.Page
+	skip := prefs.CommentsPerPage * search.Page
+
+	if search.Oldest {
+		search.Order = Order_Oldest
+	} else if search.Order != Order_Oldest && search.Order != Order_Newest {
+		search.Order = prefs.Order
+	}
 
 	q = search.MakeInitialQuery(contentapi.GetCommentFields("m"), mainpage.Id, uid)
 	q.Order = "m.id"
-	if !search.Oldest {
+	if search.Order != Order_Oldest {
 		q.Order += " DESC"
 	}
-	q.Limit = gctx.config.CommentsPerPage
+	q.Limit = prefs.CommentsPerPage
 	q.Skip = skip
 	q.Finalize()
 
@@ -192,35 +252,19 @@ func (gctx *GonContext) AddCommentData(hash string, search *CommentSearch, user
 		return nil, err
 	}
 
-	// Have to pull out only uids (maybe there's a better way, who knows)
-	commentUids := make([]int64, len(comments)+1)
-	for i := range comments {
-		commentUids[i] = comments[i].CreateUserId
-	}
-	commentUids[len(comments)] = mainpage.CreateUserId
-
-	// Need to look up users for each comment
-	users, err := gctx.GetUsers(commentUids...)
+	// Need to look up users (and values) for each comment
+	usermap, err := gctx.ApplyCommentExtras(comments, mainpage.CreateUserId)
 	if err != nil {
 		return nil, err
 	}
 
-	usermap := contentapi.GetMappedUsers(users)
-
 	// Might as well apply the thing here (though I might remove it)
 	if mainpage.ApplyUser(usermap) == nil {
 		log.Printf("WARN: couldn't find user for page %s (%d)", mainpage.Name, mainpage.Id)
 	}
 
-	// Apply user for every comment. It's fine if they don't exist
-	for i := range comments {
-		if comments[i].ApplyUser(usermap) == nil {
-			log.Printf("WARN: couldn't find user for page %s (%d)", mainpage.Name, mainpage.Id)
-		}
-	}
-
 	data["search"] = search
-	data["mainpage"] = &mainpage // Everything expects a pointer
+	data["mainpage"] = mainpage
 	data["comments"] = comments
 	data["resultcount"] = count
 	data["resultstart"] = skip + 1
@@ -232,6 +276,47 @@ func (gctx *GonContext) AddCommentData(hash string, search *CommentSearch, user
 	return comments, nil
 }
 
+// Lookup and apply the users and values for every comment given. Extra uids
+// are looked up alongside the comment users, and the user map is returned so
+// you can apply them to other things
+func (gctx *GonContext) ApplyCommentExtras(comments []contentapi.Comment, extraUids ...int64) (map[int64]*contentapi.User, error) {
+	// Have to pull out only uids (maybe there's a better way, who knows)
+	commentUids := make([]int64, 0, len(comments)+len(extraUids))
+	commentIds := make([]int64, len(comments))
+	for i := range comments {
+		commentUids = append(commentUids, comments[i].CreateUserId)
+		if comments[i].ReceiveUserId != 0 {
+			commentUids = append(commentUids, comments[i].ReceiveUserId)
+		}
+		commentIds[i] = comments[i].Id
+	}
+	commentUids = append(commentUids, extraUids...)
+
+	users, err := gctx.GetUsers(commentUids...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pull all the values for this set of comments at once
+	values, err := gctx.GetMessageValues(commentIds...)
+	if err != nil {
+		return nil, err
+	}
+
+	usermap := contentapi.GetMappedUsers(users)
+	valuemap := contentapi.GetMappedMessageValues(values)
+
+	// Apply user for every comment. It's fine if they don't exist
+	for i := range comments {
+		if comments[i].ApplyUser(usermap) == nil {
+			log.Printf("WARN: couldn't find user %d for comment %d", comments[i].CreateUserId, comments[i].Id)
+		}
+		comments[i].ApplyValues(valuemap)
+	}
+
+	return usermap, nil
+}
+
 // Add all the page data (main page, subpages, etc) for
 func (gctx *GonContext) AddPageData(hash string, user *UserSession, data map[string]any) error {
 	var uid int64
@@ -245,20 +330,11 @@ func (gctx *GonContext) AddPageData(hash string, user *UserSession, data map[str
 		// This is the root page
 		MakeRoot(&mainpage)
 	} else {
-		q := contentapi.NewQuery()
-		q.Sql = "SELECT " + contentapi.GetContentFields("c", true) + " FROM content c WHERE c.hash = ?"
-		q.AddParams(hash)
-		q.AndViewable("c.id", uid)
-		q.Finalize()
-		err := gctx.contentdb.Get(&mainpage, q.Sql, q.Params...)
-
+		page, err := gctx.GetViewablePage(hash, uid, true)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return &utils.NotFound{Message: fmt.Sprintf("No content with hash %s", hash)}
-			} else {
-				return err
-			}
+			return err
 		}
+		mainpage = *page
 	}
 
 	q := contentapi.NewQuery()
@@ -323,7 +399,7 @@ func (gctx *GonContext) AddPageData(hash string, user *UserSession, data map[str
 		q = contentapi.NewQuery()
 		q.Sql = "SELECT COUNT(*) FROM messages WHERE contentId = ?"
 		q.AddParams(mainpage.Id)
-		q.AndCommentViewable("")
+		q.AndCommentViewable("", uid, true)
 		q.Finalize()
 
 		var count int64
@@ -333,6 +409,16 @@ func (gctx *GonContext) AddPageData(hash string, user *UserSession, data map[str
 		}
 
 		data["numcomments"] = count
+
+		// Files get their size and dimensions shown. A missing upload still has a page
+		if mainpage.ContentType == contentapi.ContentType_File {
+			meta, err := gctx.GetUploadMeta(mainpage.Hash)
+			if err == nil {
+				data["filemeta"] = meta
+			} else if _, ok := err.(*utils.NotFound); !ok {
+				return err
+			}
+		}
 	}
 
 	// Because everything is a struct rather than a pointer, this actually gets copied in.
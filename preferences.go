@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	_ "time/tzdata" // Time zones work even where the system has no tz database
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+const (
+	Order_Newest = "newest"
+	Order_Oldest = "oldest"
+
+	Markup_Render = "render" // Render 12y/12y2/etc markup with the javascript renderer
+	Markup_Plain  = "plain"  // Show the raw text
+
+	PreferencesCookieAge = 365 * 24 * 60 * 60
+)
+
+// The date formats users can pick from (name -> go layout)
+var DateFormats = map[string]string{
+	"iso":  "2006-01-02 15:04:05",
+	"us":   "01/02/2006 3:04:05 PM",
+	"eu":   "02/01/2006 15:04:05",
+	"long": "Mon, Jan 2 2006 3:04 PM",
+}
+
+// Just so the preference page lists them in a sensible order
+var DateFormatNames = []string{"iso", "us", "eu", "long"}
+
+// Display settings a user can change for themselves
+type Preferences struct {
+	CommentsPerPage int    `schema:"commentsperpage" json:"commentsPerPage"`
+	Order           string `schema:"order" json:"order"`           // Default comment ordering (newest/oldest)
+	TimeZone        string `schema:"timezone" json:"timeZone"`     // IANA name, ex: America/New_York
+	DateFormat      string `schema:"dateformat" json:"dateFormat"` // One of DateFormats
+	Markup          string `schema:"markup" json:"markup"`         // render or plain
+
+	location *time.Location
+}
+
+func DefaultPreferences(config *Config) *Preferences {
+	return &Preferences{
+		CommentsPerPage: config.CommentsPerPage,
+		Order:           Order_Newest,
+		TimeZone:        "UTC",
+		DateFormat:      "iso",
+		Markup:          Markup_Render,
+		location:        time.UTC,
+	}
+}
+
+// Check the preferences against what's allowed, returning an error for the
+// first bad value
+func (p *Preferences) Validate(config *Config) error {
+	if p.CommentsPerPage < config.MinCommentsPerPage || p.CommentsPerPage > config.MaxCommentsPerPage {
+		return &utils.BadRequest{Message: fmt.Sprintf("Comments per page must be between %d and %d", config.MinCommentsPerPage, config.MaxCommentsPerPage)}
+	}
+	if p.Order != Order_Newest && p.Order != Order_Oldest {
+		return &utils.BadRequest{Message: fmt.Sprintf("Unknown order %s", p.Order)}
+	}
+	if _, ok := DateFormats[p.DateFormat]; !ok {
+		return &utils.BadRequest{Message: fmt.Sprintf("Unknown date format %s", p.DateFormat)}
+	}
+	if p.Markup != Markup_Render && p.Markup != Markup_Plain {
+		return &utils.BadRequest{Message: fmt.Sprintf("Unknown markup mode %s", p.Markup)}
+	}
+	location, err := LoadTimeZone(p.TimeZone)
+	if err != nil {
+		return &utils.BadRequest{Message: err.Error()}
+	}
+	p.location = location
+	return nil
+}
+
+// Like time.LoadLocation, but only for real zone names (not "" or "Local",
+// which mean the server's zone)
+func LoadTimeZone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("Unknown time zone %s", name)
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown time zone %s", name)
+	}
+	return location, nil
+}
+
+// Fix anything invalid in stored preferences (the admin may have changed the
+// bounds since, etc) by falling back to the defaults one value at a time
+func (p *Preferences) Sanitize(config *Config) {
+	defaults := DefaultPreferences(config)
+	p.CommentsPerPage = min(max(p.CommentsPerPage, config.MinCommentsPerPage), config.MaxCommentsPerPage)
+	if p.Order != Order_Newest && p.Order != Order_Oldest {
+		p.Order = defaults.Order
+	}
+	if _, ok := DateFormats[p.DateFormat]; !ok {
+		p.DateFormat = defaults.DateFormat
+	}
+	if p.Markup != Markup_Render && p.Markup != Markup_Plain {
+		p.Markup = defaults.Markup
+	}
+	location, err := LoadTimeZone(p.TimeZone)
+	if err != nil {
+		p.TimeZone = defaults.TimeZone
+		location = defaults.location
+	}
+	p.location = location
+}
+
+func (p *Preferences) Oldest() bool {
+	return p.Order == Order_Oldest
+}
+
+func (p *Preferences) RenderMarkup() bool {
+	return p.Markup != Markup_Plain
+}
+
+func (p *Preferences) Location() *time.Location {
+	if p.location == nil {
+		return time.UTC
+	}
+	return p.location
+}
+
+// Show a database date in the user's time zone and format
+func (p *Preferences) FormatDate(date contentapi.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.In(p.Location()).Format(DateFormats[p.DateFormat])
+}
+
+// The current user's preferences: from the sidecar database for logged in
+// users, from a cookie for everyone else. Anything missing or invalid is the default
+func (gctx *GonContext) GetPreferences(r *http.Request, user *UserSession) *Preferences {
+	config := gctx.Config()
+	prefs := DefaultPreferences(config)
+	if gctx.staticExport {
+		return prefs
+	}
+	var raw []byte
+	if user != nil {
+		var data string
+		err := gctx.sidecardb.Get(&data, "SELECT data FROM preferences WHERE userId = ?", user.Uid)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("WARN: couldn't load preferences for %d: %s", user.Uid, err)
+		}
+		raw = []byte(data)
+	} else if cookie, err := r.Cookie(config.PreferencesCookie); err == nil {
+		raw, _ = base64.RawURLEncoding.DecodeString(cookie.Value)
+	}
+	if len(raw) > 0 {
+		err := json.Unmarshal(raw, prefs)
+		if err != nil {
+			log.Printf("WARN: bad preferences: %s", err)
+			prefs = DefaultPreferences(config)
+		}
+	}
+	prefs.Sanitize(config)
+	return prefs
+}
+
+// Save the preferences for the current user (they must already be validated)
+func (gctx *GonContext) SavePreferences(w http.ResponseWriter, user *UserSession, prefs *Preferences) error {
+	raw, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		_, err = gctx.sidecardb.Exec("INSERT OR REPLACE INTO preferences(userId, data, updateDate) VALUES (?,?,?)",
+			user.Uid, string(raw), time.Now().UTC().Format(time.RFC3339))
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   gctx.Config().PreferencesCookie,
+		Value:  base64.RawURLEncoding.EncodeToString(raw),
+		Path:   gctx.Config().RootPath + "/",
+		MaxAge: PreferencesCookieAge,
+	})
+	return nil
+}
+
+// Go back to the defaults for the current user
+func (gctx *GonContext) ResetPreferences(w http.ResponseWriter, user *UserSession) error {
+	if user != nil {
+		_, err := gctx.sidecardb.Exec("DELETE FROM preferences WHERE userId = ?", user.Uid)
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   gctx.Config().PreferencesCookie,
+		Value:  "",
+		Path:   gctx.Config().RootPath + "/",
+		MaxAge: -1,
+	})
+	return nil
+}
+
+// Everything the preferences page needs
+func (gctx *GonContext) AddPreferencesData(prefs *Preferences, data map[string]any) {
+	config := gctx.Config()
+	data["title"] = "Preferences"
+	data["prefs"] = prefs
+	data["mincommentsperpage"] = config.MinCommentsPerPage
+	data["maxcommentsperpage"] = config.MaxCommentsPerPage
+	data["dateformats"] = DateFormatNames
+	examples := make(map[string]string, len(DateFormats))
+	now := time.Now().In(prefs.Location())
+	for name, layout := range DateFormats {
+		examples[name] = now.Format(layout)
+	}
+	data["dateformatexamples"] = examples
+}
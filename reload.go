@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+// Config fields that are only used on startup (the listener, the database
+// handle, the file servers). Changing them requires a restart
+var restartOnlyFields = []string{"Address", "Database", "SidecarDatabase", "StaticFiles", "Uploads", "Themes", "HeaderLimit", "Timeout", "ShutdownTime", "ThumbnailWorkers", "ThumbnailFolder"}
+
+// Swap in a new config, re-parsing the templates for it. Nothing is replaced
+// unless everything is valid. Fields that can't change without a restart are
+// kept from the old config (with a warning)
+func (gctx *GonContext) Reload(config *Config) error {
+	current := gctx.Config()
+	newConfig := *config
+	for _, field := range restartOnlyFields {
+		if copyConfigField(&newConfig, current, field) {
+			log.Printf("WARN: %s changed; restart to apply it", field)
+		}
+	}
+
+	templates, themes, err := ParseThemes(&newConfig)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(newConfig.ThumbnailFolder, 0750)
+	if err != nil {
+		return err
+	}
+	// The static files may have changed on disk too
+	cachebust, err := utils.HashFS(gctx.staticfs, gctx.themefs)
+	if err != nil {
+		return err
+	}
+
+	gctx.reloadLock.Lock()
+	defer gctx.reloadLock.Unlock()
+	gctx.config = &newConfig
+	gctx.templates = templates
+	gctx.themes = themes
+	gctx.cachebust = cachebust
+	gctx.thumbnailCache.SetLimit(newConfig.ThumbnailCacheBytes())
+	return nil
+}
+
+// Re-parse just the templates with the current config
+func (gctx *GonContext) ReloadTemplates() error {
+	config := gctx.Config()
+	templates, themes, err := ParseThemes(config)
+	if err != nil {
+		return err
+	}
+	gctx.reloadLock.Lock()
+	defer gctx.reloadLock.Unlock()
+	// Someone else may have reloaded the whole config in the meantime; theirs wins
+	if gctx.config == config {
+		gctx.templates = templates
+		gctx.themes = themes
+	}
+	return nil
+}
+
+// Copy a single field from one config to another, returning whether it was different
+func copyConfigField(to *Config, from *Config, field string) bool {
+	toField := reflect.ValueOf(to).Elem().FieldByName(field)
+	fromField := reflect.ValueOf(from).Elem().FieldByName(field)
+	changed := !toField.Equal(fromField)
+	toField.Set(fromField)
+	return changed
+}
+
+// Reload the config stack (and templates) every time we get a SIGHUP. A bad
+// config is logged and the old one stays in place
+func handleReloads(ctx context.Context, cli *Cli, gctx *GonContext) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupChan:
+			log.Printf("Got SIGHUP, reloading config")
+			config, _, err := cli.LoadConfig()
+			if err == nil {
+				err = gctx.Reload(config)
+			}
+			if err != nil {
+				log.Printf("ERROR: reload failed, keeping the old config: %s", err)
+			} else {
+				log.Printf("Reloaded config and templates")
+			}
+		}
+	}
+}
+
+// A cheap fingerprint of the template files (including themes): names, sizes
+// and modification times
+func templateSignature(config *Config) string {
+	files := make([]string, 0)
+	if config.Templates != "" {
+		found, _ := filepath.Glob(filepath.Join(config.Templates, "*.tmpl"))
+		files = append(files, found...)
+	}
+	if config.Themes != "" {
+		found, _ := filepath.Glob(filepath.Join(config.Themes, "*", "*.tmpl"))
+		files = append(files, found...)
+	}
+	signature := ""
+	for _, f := range files {
+		stat, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		signature += fmt.Sprintf("%s:%d:%d;", f, stat.Size(), stat.ModTime().UnixNano())
+	}
+	return signature
+}
+
+// For development: re-parse the templates whenever they change on disk. This
+// polls rather than using file notifications, so it works everywhere
+func watchTemplates(ctx context.Context, gctx *GonContext, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := templateSignature(gctx.Config())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			signature := templateSignature(gctx.Config())
+			if signature == last {
+				continue
+			}
+			last = signature
+			err := gctx.ReloadTemplates()
+			if err != nil {
+				log.Printf("ERROR: templates changed but won't parse: %s", err)
+			} else {
+				log.Printf("Templates changed, reloaded")
+			}
+		}
+	}
+}
@@ -2,24 +2,13 @@ package main
 
 import (
 	"fmt"
-	"image"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"slices"
+	"strconv"
 	"time"
 
-	_ "image/gif"
-	"image/jpeg"
-	_ "image/jpeg"
-	_ "image/png"
-
-	_ "golang.org/x/image/bmp"
-	_ "golang.org/x/image/tiff"
-	_ "golang.org/x/image/webp"
-
-	"github.com/disintegration/imaging"
 	"github.com/go-chi/chi/v5"
 
 	"github.com/randomouscrap98/gontentapi/utils"
@@ -33,6 +22,8 @@ func handleError(err error, w http.ResponseWriter) bool {
 			http.Error(w, e.Error(), http.StatusNotFound)
 		case *utils.BadRequest:
 			http.Error(w, e.Error(), http.StatusBadRequest)
+		case *utils.Forbidden:
+			http.Error(w, e.Error(), http.StatusForbidden)
 		default:
 			http.Error(w, fmt.Sprintf("UNEXPECTED ERROR: %s", e), http.StatusInternalServerError)
 		}
@@ -45,7 +36,7 @@ func SetupRoutes(r *chi.Mux, gctx *GonContext) error {
 	// --- Normal routes ---
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		// Index has nothing for now, just take them to the pages
-		http.Redirect(w, r, gctx.config.RootPath+"/pages", http.StatusFound)
+		http.Redirect(w, r, gctx.Config().RootPath+"/pages", http.StatusFound)
 	})
 	pagesRoute := func(w http.ResponseWriter, r *http.Request) {
 		user := gctx.GetCurrentUser(r)
@@ -59,6 +50,44 @@ func SetupRoutes(r *chi.Mux, gctx *GonContext) error {
 	// Retrieving a page is the same whether you have a slug or not
 	r.Get("/pages", pagesRoute)
 	r.Get("/pages/{slug}", pagesRoute)
+	r.Get("/pages/{slug}/history", func(w http.ResponseWriter, r *http.Request) {
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		err := gctx.AddHistoryData(chi.URLParam(r, "slug"), user, data)
+		if handleError(err, w) {
+			return
+		}
+		gctx.RunTemplate("history.tmpl", w, data)
+	})
+	r.Get("/pages/{slug}/history/{rid:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		rid, err := strconv.ParseInt(chi.URLParam(r, "rid"), 10, 64)
+		if handleError(err, w) {
+			return
+		}
+		err = gctx.AddRevisionData(chi.URLParam(r, "slug"), rid, user, data)
+		if handleError(err, w) {
+			return
+		}
+		gctx.RunTemplate("revision.tmpl", w, data)
+	})
+	r.Get("/pages/{slug}/diff", func(w http.ResponseWriter, r *http.Request) {
+		if handleError(r.ParseForm(), w) {
+			return
+		}
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		var search DiffSearch
+		if handleError(gctx.decoder.Decode(&search, r.Form), w) {
+			return
+		}
+		err := gctx.AddDiffData(chi.URLParam(r, "slug"), &search, user, data)
+		if handleError(err, w) {
+			return
+		}
+		gctx.RunTemplate("diff.tmpl", w, data)
+	})
 	r.Get("/comments/{slug}", func(w http.ResponseWriter, r *http.Request) {
 		if handleError(r.ParseForm(), w) {
 			return
@@ -70,26 +99,61 @@ func SetupRoutes(r *chi.Mux, gctx *GonContext) error {
 			return
 		}
 		_, iframe := r.Form["iframe"] // Iframe is if it exists at all, not the value
-		comments, err := gctx.AddCommentData(chi.URLParam(r, "slug"), &search, user, data)
+		// The iframe paging only makes sense newest first
+		if iframe && search.Order == "" {
+			search.Order = Order_Newest
+		}
+		prefs := data["prefs"].(*Preferences)
+		comments, err := gctx.AddCommentData(chi.URLParam(r, "slug"), &search, user, prefs, data)
 		if handleError(err, w) {
 			return
 		}
+		// Special paging system, separate from search (but adjacent/uses same fields).
+		// Only shown for iframes and the static export
+		params := url.Values{}
 		if iframe {
-			// Special iframe system, separate from search (but adjacent/uses same fields)
-			params := url.Values{}
 			params.Add("iframe", "1")
-			if search.Page > 0 {
-				params.Set("page", fmt.Sprint(search.Page-1))
-				data["newerpageurl"] = "?" + params.Encode()
-			}
-			if len(comments) == gctx.config.CommentsPerPage {
-				params.Set("page", fmt.Sprint(search.Page+1))
-				data["olderpageurl"] = "?" + params.Encode()
-			}
 			data["iframe"] = true
 		}
+		if search.Page > 0 {
+			params.Set("page", fmt.Sprint(search.Page-1))
+			data["newerpageurl"] = "?" + params.Encode()
+		}
+		if len(comments) == prefs.CommentsPerPage {
+			params.Set("page", fmt.Sprint(search.Page+1))
+			data["olderpageurl"] = "?" + params.Encode()
+		}
 		gctx.RunTemplate("comments.tmpl", w, data)
 	})
+	r.Get("/comments/{slug}/archive", func(w http.ResponseWriter, r *http.Request) {
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		err := gctx.AddArchiveData(chi.URLParam(r, "slug"), user, data)
+		if handleError(err, w) {
+			return
+		}
+		gctx.RunTemplate("archive.tmpl", w, data)
+	})
+	r.Get("/comments/{slug}/archive/{day}", func(w http.ResponseWriter, r *http.Request) {
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		err := gctx.AddArchiveDayData(chi.URLParam(r, "slug"), chi.URLParam(r, "day"), user, data)
+		if handleError(err, w) {
+			return
+		}
+		gctx.RunTemplate("archiveday.tmpl", w, data)
+	})
+	r.Get("/comments/{slug}/export", func(w http.ResponseWriter, r *http.Request) {
+		if handleError(r.ParseForm(), w) {
+			return
+		}
+		user := gctx.GetCurrentUser(r)
+		var search ExportSearch
+		if handleError(gctx.decoder.Decode(&search, r.Form), w) {
+			return
+		}
+		handleError(gctx.WriteCommentExport(w, chi.URLParam(r, "slug"), &search, user, gctx.GetPreferences(r, user)), w)
+	})
 	r.Get("/search", func(w http.ResponseWriter, r *http.Request) {
 		if handleError(r.ParseForm(), w) {
 			return
@@ -101,11 +165,75 @@ func SetupRoutes(r *chi.Mux, gctx *GonContext) error {
 			return
 		}
 		// We now have a search. Add the search data and return the rendered page
-		if handleError(gctx.AddSearchResults(&search, user, data), w) {
+		if handleError(gctx.AddSearchResults(&search, user, data["prefs"].(*Preferences), data), w) {
 			return
 		}
 		gctx.RunTemplate("search.tmpl", w, data)
 	})
+	r.Get("/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		if handleError(r.ParseForm(), w) {
+			return
+		}
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		search := DuplicateSearch{Distance: DefaultDuplicateDistance}
+		if handleError(gctx.decoder.Decode(&search, r.Form), w) {
+			return
+		}
+		if handleError(gctx.AddDuplicatesData(&search, user, data), w) {
+			return
+		}
+		gctx.RunTemplate("duplicates.tmpl", w, data)
+	})
+	// Hashing changes things, so it's a post; the results are shown right away
+	r.Post("/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		if handleError(r.ParseForm(), w) {
+			return
+		}
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		search := DuplicateSearch{Distance: DefaultDuplicateDistance}
+		if handleError(gctx.decoder.Decode(&search, r.Form), w) {
+			return
+		}
+		if handleError(gctx.AddDuplicateHashUpdate(user, data), w) {
+			return
+		}
+		if handleError(gctx.AddDuplicatesData(&search, user, data), w) {
+			return
+		}
+		gctx.RunTemplate("duplicates.tmpl", w, data)
+	})
+	r.Get("/preferences", func(w http.ResponseWriter, r *http.Request) {
+		user := gctx.GetCurrentUser(r)
+		data := gctx.GetDefaultData(r, user)
+		gctx.AddPreferencesData(data["prefs"].(*Preferences), data)
+		data["saved"] = r.URL.Query().Has("saved")
+		gctx.RunTemplate("preferences.tmpl", w, data)
+	})
+	r.Post("/preferences", func(w http.ResponseWriter, r *http.Request) {
+		if handleError(r.ParseForm(), w) {
+			return
+		}
+		user := gctx.GetCurrentUser(r)
+		if r.FormValue("reset") != "" {
+			if handleError(gctx.ResetPreferences(w, user), w) {
+				return
+			}
+		} else {
+			prefs := DefaultPreferences(gctx.Config())
+			if handleError(gctx.decoder.Decode(prefs, r.PostForm), w) {
+				return
+			}
+			if handleError(prefs.Validate(gctx.Config()), w) {
+				return
+			}
+			if handleError(gctx.SavePreferences(w, user, prefs), w) {
+				return
+			}
+		}
+		http.Redirect(w, r, gctx.Config().RootPath+"/preferences?saved=1", http.StatusSeeOther)
+	})
 	r.Post("/login", func(w http.ResponseWriter, r *http.Request) {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
@@ -122,74 +250,75 @@ func SetupRoutes(r *chi.Mux, gctx *GonContext) error {
 		}
 		// Set the cookie
 		http.SetCookie(w, &http.Cookie{
-			Name:   gctx.config.LoginCookie,
+			Name:   gctx.Config().LoginCookie,
 			Value:  sessid,
-			MaxAge: int(time.Duration(gctx.config.LoginExpire).Seconds()),
+			MaxAge: int(time.Duration(gctx.Config().LoginExpire).Seconds()),
+		})
+		http.Redirect(w, r, returnUrl, http.StatusSeeOther)
+	})
+	r.Post("/theme", func(w http.ResponseWriter, r *http.Request) {
+		theme := r.FormValue("theme")
+		returnUrl := r.FormValue("return")
+		if !slices.Contains(gctx.ThemeNames(), theme) {
+			handleError(&utils.BadRequest{Message: fmt.Sprintf("No theme named %s", theme)}, w)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:   gctx.Config().ThemeCookie,
+			Value:  theme,
+			Path:   gctx.Config().RootPath + "/",
+			MaxAge: ThemeCookieAge,
 		})
 		http.Redirect(w, r, returnUrl, http.StatusSeeOther)
 	})
 	r.Post("/logout", func(w http.ResponseWriter, r *http.Request) {
 		returnUrl := r.FormValue("return")
-		utils.DeleteCookie(gctx.config.LoginCookie, w)
+		utils.DeleteCookie(gctx.Config().LoginCookie, w)
 		http.Redirect(w, r, returnUrl, http.StatusSeeOther)
 	})
 	r.Get("/thumbnails/{slug:[a-z0-9_-]+}", func(w http.ResponseWriter, r *http.Request) {
+		options, err := gctx.ParseImageOptions(r.URL.Query(), gctx.ThumbnailOptions())
+		if handleError(err, w) {
+			return
+		}
+		gctx.ServeImage(w, r, chi.URLParam(r, "slug"), options)
+	})
+	r.Get("/uploads/{slug:[a-z0-9_-]+}", func(w http.ResponseWriter, r *http.Request) {
 		imgslug := chi.URLParam(r, "slug")
-		thumbpath := filepath.Join(gctx.config.ThumbnailFolder, imgslug)
-		// Must check for thumbnail in lock. Hopefully the thumbnail exists and we
-		// skip all that generation crap
-		gctx.thumbnailLock.Lock()
-		defer gctx.thumbnailLock.Unlock()
-		file, err := os.Open(thumbpath)
-		if err != nil {
-			// This is a weird error; we only handle non-existent thumbnails
-			if !os.IsNotExist(err) {
-				handleError(err, w)
-				return
-			}
-			// Load the original image so we can make a thumbnail
-			origfile, err := os.Open(filepath.Join(gctx.config.Uploads, imgslug))
-			if handleError(err, w) {
-				return
-			}
-			defer origfile.Close()
-			img, _, err := image.Decode(origfile)
-			// Then we just use a third party library to generate a thumbnail
-			thumbimg := imaging.Thumbnail(img, gctx.config.ThumbnailSize, gctx.config.ThumbnailSize, imaging.Lanczos)
-			outfile, err := os.Create(thumbpath)
-			if handleError(err, w) {
-				return
-			}
-			options := jpeg.Options{
-				Quality: gctx.config.ThumbnailJpegQuality,
-			}
-			err = jpeg.Encode(outfile, thumbimg, &options)
-			outfile.Close()
-			if handleError(err, w) {
-				return
-			}
-			file, err = os.Open(thumbpath)
-			if handleError(err, w) {
-				return
-			}
+		query := r.URL.Query()
+		// The original file unless they asked for resizing (like old contentapi)
+		if !query.Has("size") && !query.Has("crop") && !query.Has("format") {
+			gctx.ServeUpload(w, r, imgslug)
+			return
+		}
+		defaults := ImageOptions{Size: gctx.Config().ThumbnailSize, Format: ImageFormat_Auto}
+		options, err := gctx.ParseImageOptions(query, defaults)
+		if handleError(err, w) {
+			return
+		}
+		gctx.ServeImage(w, r, imgslug, options)
+	})
+	r.Get("/uploads/{slug:[a-z0-9_-]+}/meta", func(w http.ResponseWriter, r *http.Request) {
+		meta, err := gctx.GetUploadMeta(chi.URLParam(r, "slug"))
+		if handleError(err, w) {
+			return
+		}
+		utils.RespondJson(meta, w, nil)
+	})
+	r.Get("/avatars/{uid:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		uid, err := strconv.ParseInt(chi.URLParam(r, "uid"), 10, 64)
+		if handleError(err, w) {
+			return
 		}
-		// Serve the thumbnail. We don't go check the modtime, just use the
-		// system start date (it's fine, the files shouldn't change during runtime
-		// but MIGHT change between runs...)
-		http.ServeContent(w, r, imgslug+".jpg", gctx.created, file)
-		file.Close()
+		gctx.ServeAvatar(w, r, uid)
 	})
 	// --- Static files ---
 	utils.AngryRobots(r)
-	err := utils.FileServer(r, "/static", gctx.config.StaticFiles, true)
-	if err != nil {
-		return err
-	}
-	log.Printf("Hosting static files at %s\n", gctx.config.StaticFiles)
-	err = utils.FileServer(r, "/uploads", gctx.config.Uploads, false)
-	if err != nil {
-		return err
+	utils.FileServerFS(r, "/static", gctx.staticfs, true)
+	utils.FileServerFS(r, "/themes", gctx.themefs, true)
+	if gctx.Config().StaticFiles != "" {
+		log.Printf("Hosting static files at %s (over the built-in ones)\n", gctx.Config().StaticFiles)
 	}
-	log.Printf("Hosting uploads at %s\n", gctx.config.StaticFiles)
+	log.Printf("Hosting uploads at %s\n", gctx.Config().Uploads)
 	return nil
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The sidecar database holds everything gontentapi itself needs to remember
+// (the contentapi database is only ever read). Each entry is run once, in
+// order; only ever add to the end of this list
+var sidecarMigrations = []string{
+	`CREATE TABLE preferences (
+		userId INTEGER PRIMARY KEY,
+		data TEXT NOT NULL,
+		updateDate TEXT NOT NULL
+	)`,
+	// Perceptual hashes of uploads for finding duplicates. Size and modified
+	// (unix nanoseconds) say when it needs hashing again; dhash is NULL for
+	// uploads that aren't images
+	`CREATE TABLE image_hashes (
+		hash TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		modified INTEGER NOT NULL,
+		dhash INTEGER,
+		updateDate TEXT NOT NULL
+	)`,
+}
+
+// Open (and create or upgrade if needed) the sidecar database
+func OpenSidecar(path string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d&_journal_mode=WAL", path, BusyTimeout))
+	if err != nil {
+		return nil, err
+	}
+	var version int
+	err = db.Get(&version, "PRAGMA user_version")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for i := version; i < len(sidecarMigrations); i++ {
+		tx, err := db.Beginx()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		_, err = tx.Exec(sidecarMigrations[i])
+		if err == nil {
+			// Pragmas can't take parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sidecar migration %d: %w", i+1, err)
+		}
+	}
+	return db, nil
+}
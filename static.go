@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+// The default static files and templates are built into the binary, so a
+// deploy only needs the executable. Folders on disk can still override them
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err) // Only possible with a bad path, which is a programming error
+	}
+	return sub
+}
+
+// All static files: the StaticFiles folder (if set) over the built-in ones
+func StaticFS(config *Config) fs.FS {
+	return append(utils.LayeredFS{}.WithDir(config.StaticFiles), mustSub(embeddedStatic, "static"))
+}
+
+// All templates: the Templates folder (if set) over the built-in ones
+func TemplateFS(config *Config) fs.FS {
+	return append(utils.LayeredFS{}.WithDir(config.Templates), mustSub(embeddedStatic, "static/templates"))
+}
@@ -33,3 +33,13 @@ var Nav = {
 HTMLImageElement.prototype.decode = function() {
     return Promise.resolve(true);
 };
+
+// Render everything that says what markup it uses. The text is already in the
+// element (so it's still readable without javascript), we just replace it
+window.addEventListener("DOMContentLoaded", function() {
+    document.querySelectorAll("[data-markup]").forEach(function(element) {
+        var text = element.textContent;
+        element.textContent = "";
+        Markup.convert_lang(text, element.dataset.markup, element);
+    });
+});
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+)
+
+const (
+	StaticSearchIndex = "searchindex.json"
+	StaticSearchJs    = "searchindex.js"
+)
+
+// A single entry in the exported search index
+type StaticSearchEntry struct {
+	Id           int64  `json:"id"`
+	Name         string `json:"name"`
+	Hash         string `json:"hash"`
+	ContentType  int    `json:"contentType"`
+	Created      string `json:"createDate"`
+	CreateUserId int64  `json:"createUserId"`
+	Private      bool   `json:"private,omitempty"`
+	Url          string `json:"url"` // Relative to the export root
+}
+
+// Renders the entire site (as seen by a single user) into a directory of
+// plain files that can be browsed without gontentapi running
+type StaticExporter struct {
+	gctx      *GonContext
+	handler   http.Handler
+	output    string
+	uid       int64
+	cookie    *http.Cookie
+	linkRegex *regexp.Regexp
+	uploads   map[string]struct{}
+	avatars   map[string]string // Export path -> site url
+	index     []StaticSearchEntry
+}
+
+var srcsetRegex = regexp.MustCompile(` srcset="[^"]*"`)
+
+func NewStaticExporter(gctx *GonContext, output string, uid int64) (*StaticExporter, error) {
+	// We don't want the logger or any of that stuff, just the routes. A bad
+	// upload shouldn't kill the whole export though
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+	err := SetupRoutes(r, gctx)
+	if err != nil {
+		return nil, err
+	}
+	linkRegex, err := regexp.Compile(`(href|src)="([^"]*)"`)
+	if err != nil {
+		return nil, err
+	}
+	exporter := &StaticExporter{
+		gctx:      gctx,
+		handler:   r,
+		output:    output,
+		uid:       uid,
+		linkRegex: linkRegex,
+		uploads:   make(map[string]struct{}),
+		avatars:   make(map[string]string),
+		index:     make([]StaticSearchEntry, 0),
+	}
+	if uid != 0 {
+		// Pretend to be logged in as the given user. This doesn't need a password,
+		// you're already on the server
+		users, err := gctx.GetUsers(uid)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("no user with id %d", uid)
+		}
+		sessid, err := gctx.AddSession(&UserSession{
+			Uid:      users[0].Id,
+			Username: users[0].Username,
+			Avatar:   users[0].Avatar,
+			Created:  gctx.created,
+		})
+		if err != nil {
+			return nil, err
+		}
+		exporter.cookie = &http.Cookie{Name: gctx.Config().LoginCookie, Value: sessid}
+	}
+	return exporter, nil
+}
+
+// Figure out where the given site url should live in the export. Returns
+// false if the url isn't something we export. Any uploads seen are tracked
+// so they can be copied at the end
+func (e *StaticExporter) StaticPath(u *url.URL) (string, bool) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for _, p := range parts[1:] {
+		if !filepath.IsLocal(p) {
+			return "", false
+		}
+	}
+	query := u.Query()
+	switch {
+	case u.Path == "/" || u.Path == "/pages":
+		return "pages/index.html", true
+	case parts[0] == "pages" && len(parts) == 2:
+		return fmt.Sprintf("pages/%s.html", parts[1]), true
+	case parts[0] == "comments" && len(parts) == 2:
+		page := query.Get("page")
+		if page == "" {
+			page = "0"
+		}
+		query.Del("page")
+		if query.Has("iframe") {
+			query.Del("iframe")
+			if len(query) == 0 {
+				return fmt.Sprintf("comments/%s/iframe-%s.html", parts[1], page), true
+			}
+		} else if len(query) == 0 {
+			return fmt.Sprintf("comments/%s/page-%s.html", parts[1], page), true
+		}
+	case parts[0] == "uploads" && len(parts) == 2:
+		e.uploads[parts[1]] = struct{}{}
+		return "uploads/" + parts[1], true
+	case parts[0] == "thumbnails" && len(parts) == 2:
+		e.uploads[parts[1]] = struct{}{}
+		return "thumbnails/" + parts[1], true
+	case parts[0] == "avatars" && len(parts) == 2:
+		// Messages can have their own avatar, those are separate files
+		staticPath := "avatars/" + parts[1]
+		if avatar := query.Get("avatar"); avatar != "" && filepath.IsLocal(avatar) {
+			staticPath += "-" + avatar
+		}
+		e.avatars[staticPath] = "/avatars/" + parts[1] + "?avatar=" + url.QueryEscape(query.Get("avatar"))
+		return staticPath, true
+	case (parts[0] == "static" || parts[0] == "themes") && len(parts) > 1:
+		return strings.Join(parts, "/"), true
+	case u.Path == "/search":
+		return "search.html", true
+	}
+	return "", false
+}
+
+// Rewrite all the links in the given html (from the given site url) so they
+// point to the exported files relative to where this file will be
+func (e *StaticExporter) RewriteLinks(page []byte, current *url.URL, currentPath string) []byte {
+	root := e.gctx.Config().RootPath
+	// Only one size of each thumbnail is exported, so the high-DPI ones have to go
+	page = srcsetRegex.ReplaceAll(page, nil)
+	return e.linkRegex.ReplaceAllFunc(page, func(match []byte) []byte {
+		groups := e.linkRegex.FindSubmatch(match)
+		link := html.UnescapeString(string(groups[2]))
+		var target *url.URL
+		var err error
+		if strings.HasPrefix(link, "?") {
+			target, err = url.Parse(current.Path + link)
+		} else if strings.HasPrefix(link, root+"/") {
+			target, err = url.Parse(strings.TrimPrefix(link, root))
+		} else {
+			return match
+		}
+		if err != nil {
+			return match
+		}
+		staticPath, ok := e.StaticPath(target)
+		if !ok {
+			return match
+		}
+		relative, err := filepath.Rel(filepath.Dir(filepath.FromSlash(currentPath)), filepath.FromSlash(staticPath))
+		if err != nil {
+			return match
+		}
+		relative = filepath.ToSlash(relative)
+		if target.Fragment != "" {
+			relative += "#" + target.Fragment
+		}
+		return []byte(fmt.Sprintf(`%s="%s"`, groups[1], html.EscapeString(relative)))
+	})
+}
+
+// Run a request through the real handlers and return the body
+func (e *StaticExporter) Fetch(u *url.URL) ([]byte, error) {
+	req := httptest.NewRequest("GET", u.String(), nil)
+	if e.cookie != nil {
+		req.AddCookie(e.cookie)
+	}
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d: %s", u, rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+	return rec.Body.Bytes(), nil
+}
+
+// Write a file into the export, creating directories as needed
+func (e *StaticExporter) WriteFile(staticPath string, data []byte) error {
+	fullpath := filepath.Join(e.output, filepath.FromSlash(staticPath))
+	err := os.MkdirAll(filepath.Dir(fullpath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fullpath, data, 0644)
+}
+
+// Render a single site page into the export
+func (e *StaticExporter) ExportPage(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	staticPath, ok := e.StaticPath(u)
+	if !ok {
+		return fmt.Errorf("can't export %s", rawurl)
+	}
+	page, err := e.Fetch(u)
+	if err != nil {
+		return err
+	}
+	return e.WriteFile(staticPath, e.RewriteLinks(page, u, staticPath))
+}
+
+// Render every comment page for the given content, both the iframe and
+// normal versions
+func (e *StaticExporter) ExportComments(c *contentapi.Content) error {
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT COUNT(*) FROM messages m WHERE m.contentId = ?"
+	q.AddParams(c.Id)
+	q.AndCommentViewable("m", e.uid, true)
+	q.Finalize()
+	var count int
+	err := e.gctx.contentdb.Get(&count, q.Sql, q.Params...)
+	if err != nil {
+		return err
+	}
+	perPage := e.gctx.Config().CommentsPerPage
+	pages := max(1, (count+perPage-1)/perPage)
+	for i := range pages {
+		err = e.ExportPage(fmt.Sprintf("/comments/%s?page=%d", url.PathEscape(c.Hash), i))
+		if err != nil {
+			return err
+		}
+		err = e.ExportPage(fmt.Sprintf("/comments/%s?iframe=1&page=%d", url.PathEscape(c.Hash), i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy all the static files (css, markup, etc) and themes as-is
+func (e *StaticExporter) ExportStatic() error {
+	err := fs.WalkDir(e.gctx.themefs, ".", func(p string, d fs.DirEntry, err error) error {
+		// Theme templates are just as useless as the regular ones
+		if err != nil || d.IsDir() || path.Ext(p) == ".tmpl" {
+			return err
+		}
+		data, err := fs.ReadFile(e.gctx.themefs, p)
+		if err != nil {
+			return err
+		}
+		return e.WriteFile(path.Join("themes", p), data)
+	})
+	if err != nil {
+		return err
+	}
+	return fs.WalkDir(e.gctx.staticfs, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Templates are in the static folder, but they're useless here
+			if p == "templates" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		data, err := fs.ReadFile(e.gctx.staticfs, p)
+		if err != nil {
+			return err
+		}
+		return e.WriteFile(path.Join("static", p), data)
+	})
+}
+
+// Copy every upload referenced by an exported page, plus its thumbnail
+func (e *StaticExporter) ExportUploads() error {
+	for hash := range e.uploads {
+		// Through the handler too, so uploads are stripped the same as when served
+		data, err := e.Fetch(&url.URL{Path: "/uploads/" + hash})
+		if err != nil {
+			log.Printf("WARN: skipping upload %s: %s", hash, err)
+			continue
+		}
+		err = e.WriteFile("uploads/"+hash, data)
+		if err != nil {
+			return err
+		}
+		// Thumbnails go through the handler so they're generated if needed
+		thumbnail, err := e.Fetch(&url.URL{Path: "/thumbnails/" + hash})
+		if err != nil {
+			log.Printf("WARN: skipping thumbnail %s: %s", hash, err)
+			continue
+		}
+		err = e.WriteFile("thumbnails/"+hash, thumbnail)
+		if err != nil {
+			return err
+		}
+	}
+	for staticPath, link := range e.avatars {
+		target, err := url.Parse(link)
+		if err != nil {
+			return err
+		}
+		avatar, err := e.Fetch(target)
+		if err != nil {
+			log.Printf("WARN: skipping avatar %s: %s", link, err)
+			continue
+		}
+		err = e.WriteFile(staticPath, avatar)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the search index (as both json and a script, since browsers won't
+// fetch json from file://) along with the page that searches it
+func (e *StaticExporter) ExportSearch() error {
+	indexJson, err := json.Marshal(e.index)
+	if err != nil {
+		return err
+	}
+	err = e.WriteFile(StaticSearchIndex, indexJson)
+	if err != nil {
+		return err
+	}
+	err = e.WriteFile(StaticSearchJs, []byte(fmt.Sprintf("var SearchIndex = %s;\n", indexJson)))
+	if err != nil {
+		return err
+	}
+	req := httptest.NewRequest("GET", "/search", nil)
+	data := e.gctx.GetDefaultData(req, nil)
+	data["title"] = "Search"
+	data["searchindex"] = StaticSearchJs
+	var page bytes.Buffer
+	err = e.gctx.Templates(data["theme"].(string)).ExecuteTemplate(&page, "staticsearch.tmpl", data)
+	if err != nil {
+		return err
+	}
+	return e.WriteFile("search.html", e.RewriteLinks(page.Bytes(), req.URL, "search.html"))
+}
+
+// Export everything the user can see
+func (e *StaticExporter) Export() error {
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT " + contentapi.GetContentFields("c", false) + " FROM content c WHERE 1"
+	q.AndViewable("c.id", e.uid)
+	q.Order = "c.id"
+	q.Finalize()
+
+	content := make([]contentapi.Content, 0)
+	err := e.gctx.contentdb.Select(&content, q.Sql, q.Params...)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exporting %d pages to %s", len(content)+1, e.output)
+
+	err = e.ExportPage("/pages")
+	if err != nil {
+		return err
+	}
+
+	for i, c := range content {
+		err = e.ExportPage("/pages/" + url.PathEscape(c.Hash))
+		if err != nil {
+			return err
+		}
+		err = e.ExportComments(&c)
+		if err != nil {
+			return err
+		}
+		staticPath, _ := e.StaticPath(&url.URL{Path: "/pages/" + c.Hash})
+		e.index = append(e.index, StaticSearchEntry{
+			Id:           c.Id,
+			Name:         c.Name,
+			Hash:         c.Hash,
+			ContentType:  c.ContentType,
+			Created:      c.Created.String(),
+			CreateUserId: c.CreateUserId,
+			Private:      c.Private,
+			Url:          staticPath,
+		})
+		if (i+1)%100 == 0 {
+			log.Printf("Exported %d/%d pages", i+1, len(content))
+		}
+	}
+
+	err = e.ExportSearch()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Copying static files and %d uploads", len(e.uploads))
+
+	err = e.ExportStatic()
+	if err != nil {
+		return err
+	}
+
+	return e.ExportUploads()
+}
+
+// The export command: render the site to a directory
+func runExport(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("out", "export", "Directory to write the site to")
+	uid := flags.Int64("uid", 0, "Export the site as seen by this user (0 is anonymous)")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	_, gctx, err := cli.LoadContext()
+	if err != nil {
+		return err
+	}
+	gctx.staticExport = true
+
+	exporter, err := NewStaticExporter(gctx, *output, *uid)
+	if err != nil {
+		return err
+	}
+	err = exporter.Export()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Export complete: %s", *output)
+	return nil
+}
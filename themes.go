@@ -0,0 +1,84 @@
+package main
+
+import (
+	"html/template"
+	"io/fs"
+	"net/http"
+	"slices"
+
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+const (
+	DefaultThemeName = "default" // No theme at all, just the base templates and css
+	ThemeCookieAge   = 365 * 24 * 60 * 60
+)
+
+// All themes: the Themes folder (if set) over the built-in ones. Each theme is
+// a folder with a theme.css and optionally templates to use over the base ones
+func ThemeFS(config *Config) fs.FS {
+	return append(utils.LayeredFS{}.WithDir(config.Themes), mustSub(embeddedStatic, "static/themes"))
+}
+
+// The names of all available themes, sorted (default is always first)
+func ListThemes(config *Config) ([]string, error) {
+	entries, err := fs.ReadDir(ThemeFS(config), ".")
+	if err != nil {
+		return nil, err
+	}
+	themes := []string{DefaultThemeName}
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != DefaultThemeName {
+			themes = append(themes, e.Name())
+		}
+	}
+	slices.Sort(themes[1:])
+	return themes, nil
+}
+
+// Parse the templates for every theme. Each theme's templates are layered over
+// the base templates, so a theme only needs the ones it changes
+func ParseThemes(config *Config) (map[string]*template.Template, []string, error) {
+	themes, err := ListThemes(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := TemplateFS(config)
+	result := make(map[string]*template.Template, len(themes))
+	for _, theme := range themes {
+		fsys := base
+		if theme != DefaultThemeName {
+			fsys = utils.LayeredFS{mustSub(ThemeFS(config), theme), base}
+		}
+		result[theme], err = ParseTemplates(config, fsys)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return result, themes, nil
+}
+
+// The theme to use for the given request: the user's choice if it still
+// exists, otherwise the configured default
+func (gctx *GonContext) GetTheme(r *http.Request) string {
+	gctx.reloadLock.RLock()
+	defer gctx.reloadLock.RUnlock()
+	if !gctx.staticExport {
+		if cookie, err := r.Cookie(gctx.config.ThemeCookie); err == nil {
+			if _, ok := gctx.templates[cookie.Value]; ok {
+				return cookie.Value
+			}
+		}
+	}
+	if _, ok := gctx.templates[gctx.config.DefaultTheme]; ok {
+		return gctx.config.DefaultTheme
+	}
+	return DefaultThemeName
+}
+
+// The names of all the themes that are loaded
+func (gctx *GonContext) ThemeNames() []string {
+	gctx.reloadLock.RLock()
+	defer gctx.reloadLock.RUnlock()
+	return gctx.themes
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+// Thumbnails are written to files like this before being renamed into place.
+// The dot means it can never match a thumbnail slug
+const ThumbnailTempPattern = ".tmp-*"
+
+// Animated thumbnails keep at least one of every this many frames; gifs with
+// more frames than that (times ThumbnailMaxFrames) just get an icon
+const GifMaxSkip = 10
+
+// Temp files this old are from thumbnails that will never finish
+const ThumbnailTempMaxAge = time.Hour
+
+// Bump when the way images are made changes, so the old ones aren't served.
+// 2: jpegs are rotated to their exif orientation
+const ImageCacheVersion = 2
+
+const (
+	ImageFormat_Auto = "auto" // Pick by what the upload is: animated gifs stay gifs, transparent images get png, the rest jpeg
+	ImageFormat_Jpeg = "jpeg"
+	ImageFormat_Png  = "png"
+	ImageFormat_Gif  = "gif" // Only picked by auto
+)
+
+// How an upload should be resized. Every combination is cached separately
+type ImageOptions struct {
+	Size   int    // Width and height to fit in
+	Crop   bool   // Crop to a square of exactly Size, otherwise fit inside it (keeping the aspect ratio)
+	Format string // ImageFormat_Auto, ImageFormat_Jpeg or ImageFormat_Png
+}
+
+// The default thumbnail: a square of ThumbnailSize in whatever format suits the upload
+func (gctx *GonContext) ThumbnailOptions() ImageOptions {
+	return ImageOptions{Size: gctx.Config().ThumbnailSize, Crop: true, Format: ImageFormat_Auto}
+}
+
+// Whether the given size is one images can be resized to
+func (config *Config) AllowedImageSize(size int) bool {
+	return size == config.ThumbnailSize || slices.Contains(config.ImageSizes, size)
+}
+
+// Read the size, crop and format parameters over the given defaults. Sizes
+// must be in the allow list, so nobody can fill the disk with every size
+// from 1 to 4096. There's no webp encoder, so webp gets png (it keeps
+// transparency, which is what people want webp for)
+func (gctx *GonContext) ParseImageOptions(query url.Values, defaults ImageOptions) (ImageOptions, error) {
+	result := defaults
+	if raw := query.Get("size"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || !gctx.Config().AllowedImageSize(size) {
+			return result, &utils.BadRequest{Message: fmt.Sprintf("Bad size %s, allowed: %d %v", raw, gctx.Config().ThumbnailSize, gctx.Config().ImageSizes)}
+		}
+		result.Size = size
+	}
+	if raw := query.Get("crop"); raw != "" {
+		crop, err := strconv.ParseBool(raw)
+		if err != nil {
+			return result, &utils.BadRequest{Message: fmt.Sprintf("Bad crop %s, must be true or false", raw)}
+		}
+		result.Crop = crop
+	}
+	switch raw := strings.ToLower(query.Get("format")); raw {
+	case "":
+	case "auto":
+		result.Format = ImageFormat_Auto
+	case "jpeg", "jpg":
+		result.Format = ImageFormat_Jpeg
+	case "png", "webp":
+		result.Format = ImageFormat_Png
+	default:
+		return result, &utils.BadRequest{Message: fmt.Sprintf("Bad format %s, must be auto, jpeg, png or webp", raw)}
+	}
+	return result, nil
+}
+
+// The file name for a resized upload. Includes everything that changes the
+// output (quality too), so changing any of it never serves a stale image
+func (gctx *GonContext) ImageCacheName(imgslug string, options ImageOptions) string {
+	mode := "fit"
+	if options.Crop {
+		mode = "crop"
+	}
+	name := fmt.Sprintf("%s-%d-%s-q%d-v%d", imgslug, options.Size, mode, gctx.Config().ThumbnailJpegQuality, ImageCacheVersion)
+	// Only auto can make animations, so only it cares about the frame limit
+	if options.Format == ImageFormat_Auto {
+		name += fmt.Sprintf("-f%d", gctx.Config().ThumbnailMaxFrames)
+	}
+	return name + "." + options.Format
+}
+
+// Open the default thumbnail for the given upload (see OpenImage)
+func (gctx *GonContext) OpenThumbnail(imgslug string) (*os.File, error) {
+	return gctx.OpenImage(imgslug, gctx.ThumbnailOptions())
+}
+
+// Open the given upload resized with the given options, generating it first
+// if it doesn't exist. Existing images are opened without any locking;
+// generation only happens once per image at a time, and only ThumbnailWorkers
+// at once overall. You must close the file when done
+func (gctx *GonContext) OpenImage(imgslug string, options ImageOptions) (*os.File, error) {
+	// Uploads that didn't work last time won't work this time either
+	if failure, ok := gctx.thumbnailFailures.Load(imgslug); ok {
+		failure := failure.(*thumbnailFailure)
+		if time.Now().Before(failure.expires) {
+			return nil, failure.err
+		}
+		gctx.thumbnailFailures.Delete(imgslug)
+	}
+	cacheName := gctx.ImageCacheName(imgslug, options)
+	thumbpath := filepath.Join(gctx.Config().ThumbnailFolder, cacheName)
+	// Usually once. If someone else made the image and it was evicted before
+	// we could open it, we just go again
+	for attempt := 0; ; attempt++ {
+		// Hopefully the image exists and we skip all that generation crap.
+		// Images are renamed into place whole, so anything here is complete
+		file, err := os.Open(thumbpath)
+		if err == nil {
+			if gctx.imageFresh(imgslug, file) {
+				gctx.thumbnailCache.Touch(cacheName)
+				return file, nil
+			}
+			// The upload was replaced after this was made, so make it again
+			file.Close()
+		} else if !os.IsNotExist(err) {
+			// This is a weird error; we only handle non-existent images
+			return nil, err
+		}
+		var made *os.File
+		err = gctx.thumbnailFlight.Do(cacheName, func() error {
+			// Someone may have JUST finished it between our open and now
+			if file, err := os.Open(thumbpath); err == nil {
+				fresh := gctx.imageFresh(imgslug, file)
+				file.Close()
+				if fresh {
+					return nil
+				}
+			}
+			gctx.thumbnailWorkers.Acquire()
+			defer gctx.thumbnailWorkers.Release()
+			var err error
+			made, err = gctx.GenerateImage(imgslug, options, thumbpath)
+			var notFound *utils.NotFound
+			if errors.As(err, &notFound) {
+				// The upload is gone, so is anything made from it
+				gctx.thumbnailCache.Remove(cacheName)
+			}
+			return err
+		})
+		if err != nil {
+			gctx.rememberThumbnailFailure(imgslug, err)
+			return nil, err
+		}
+		// We made it, so we already have it open (it might be evicted by now)
+		if made != nil {
+			return made, nil
+		}
+		file, err = os.Open(thumbpath)
+		if err == nil || !os.IsNotExist(err) || attempt > 0 {
+			return file, err
+		}
+	}
+}
+
+// Whether the given resized image is newer than its upload
+func (gctx *GonContext) imageFresh(imgslug string, file *os.File) bool {
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	orig, err := os.Stat(filepath.Join(gctx.Config().Uploads, imgslug))
+	if err != nil {
+		return false
+	}
+	return !stat.ModTime().Before(orig.ModTime())
+}
+
+// Make the resized image for the given upload and put it at thumbpath (see
+// writeCacheFile). Returns the new image opened; you must close it
+func (gctx *GonContext) GenerateImage(imgslug string, options ImageOptions, thumbpath string) (*os.File, error) {
+	config := gctx.Config()
+	// Load the original image so we can resize it
+	origfile, err := os.Open(filepath.Join(config.Uploads, imgslug))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &utils.NotFound{Message: fmt.Sprintf("No upload %s", imgslug)}
+		}
+		return nil, err
+	}
+	defer origfile.Close()
+	img, sourceFormat, err := utils.DecodeImageLimited(origfile, int64(config.ThumbnailMaxPixels))
+	if err != nil {
+		var badRequest *utils.BadRequest
+		if errors.As(err, &badRequest) {
+			return nil, &utils.BadRequest{Message: fmt.Sprintf("Can't make thumbnail for %s: %s", imgslug, err)}
+		}
+		return nil, err
+	}
+	// Phones save photos sideways and just say which way is up
+	if sourceFormat == "jpeg" {
+		if _, err := origfile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		img = utils.Orient(img, utils.JpegOrientation(origfile))
+	}
+	// Then we just use a third party library to do the resizing. Fit never
+	// makes images bigger, crop always gives exactly the size asked for
+	resize := func(img image.Image) image.Image {
+		if options.Crop {
+			return imaging.Fill(img, options.Size, options.Size, imaging.Center, imaging.Lanczos)
+		}
+		return imaging.Fit(img, options.Size, options.Size, imaging.Lanczos)
+	}
+
+	format := options.Format
+	var animation *gif.GIF
+	if format == ImageFormat_Auto {
+		format = ImageFormat_Jpeg
+		if !utils.IsOpaque(img) {
+			format = ImageFormat_Png
+		}
+		if sourceFormat == "gif" {
+			animation, err = gctx.decodeAnimation(origfile)
+			if err != nil {
+				return nil, &utils.BadRequest{Message: fmt.Sprintf("Can't make thumbnail for %s: %s", imgslug, err)}
+			}
+			if animation != nil {
+				format = ImageFormat_Gif
+			}
+		}
+	}
+
+	return gctx.writeCacheFile(thumbpath, func(w io.Writer) error {
+		switch format {
+		case ImageFormat_Gif:
+			return gif.EncodeAll(w, utils.ResizeGif(animation, config.ThumbnailMaxFrames, resize))
+		case ImageFormat_Png:
+			return png.Encode(w, resize(img))
+		default:
+			return jpeg.Encode(w, resize(img), &jpeg.Options{Quality: config.ThumbnailJpegQuality})
+		}
+	})
+}
+
+// Write a file into the thumbnail folder and track it in the cache. It's
+// written to a temp file first, so nobody ever sees half of it. Returns the
+// new file opened before it's tracked, so it can't be evicted out from under
+// us; you must close it
+func (gctx *GonContext) writeCacheFile(path string, write func(w io.Writer) error) (*os.File, error) {
+	outfile, err := os.CreateTemp(filepath.Dir(path), ThumbnailTempPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(outfile.Name()) // Does nothing once it's renamed
+	err = write(outfile)
+	if err != nil {
+		outfile.Close()
+		return nil, err
+	}
+	err = outfile.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Temp files are private; cached files should look like any other file we make
+	err = os.Chmod(outfile.Name(), 0644)
+	if err != nil {
+		return nil, err
+	}
+	result, err := os.Open(outfile.Name())
+	if err != nil {
+		return nil, err
+	}
+	stat, err := result.Stat()
+	if err == nil {
+		err = os.Rename(outfile.Name(), path)
+	}
+	if err == nil {
+		err = gctx.thumbnailCache.Add(filepath.Base(path), stat.Size())
+	}
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// Serve the given upload resized, or an icon if it isn't an image we can resize
+func (gctx *GonContext) ServeImage(w http.ResponseWriter, r *http.Request, imgslug string, options ImageOptions) {
+	file, err := gctx.OpenImage(imgslug, options)
+	var badRequest *utils.BadRequest
+	if errors.As(err, &badRequest) {
+		// Not something we can thumbnail; show an icon for what it is instead
+		http.ServeFileFS(w, r, gctx.staticfs, gctx.ThumbnailPlaceholder(imgslug))
+		return
+	}
+	if handleError(err, w) {
+		return
+	}
+	serveImageFile(w, r, file)
+}
+
+// Serve (and close) an image from the thumbnail folder
+func serveImageFile(w http.ResponseWriter, r *http.Request, file *os.File) {
+	defer file.Close()
+	stat, err := file.Stat()
+	if handleError(err, w) {
+		return
+	}
+	// Images are remade whenever the upload changes, so when this one was made
+	// is when the image last changed
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()))
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
+}
+
+// The thumbnail cache limit in bytes
+func (config *Config) ThumbnailCacheBytes() int64 {
+	return int64(config.ThumbnailCacheLimit) * 1024 * 1024
+}
+
+// Read every frame of a gif, returning nil if there's only one. All the frames
+// together still have to fit in ThumbnailMaxPixels, and there can't be more
+// than GifMaxSkip * ThumbnailMaxFrames of them (tiny frames still cost
+// memory). Frames are counted before anything is decoded
+func (gctx *GonContext) decodeAnimation(file *os.File) (*gif.GIF, error) {
+	config := gctx.Config()
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	canvas, err := gif.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	canvasPixels := max(int64(canvas.Width)*int64(canvas.Height), 1)
+	maxFrames := min(int64(config.ThumbnailMaxPixels)/canvasPixels, int64(config.ThumbnailMaxFrames)*GifMaxSkip)
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := utils.CountGifFrames(file, int(maxFrames))
+	if err != nil {
+		return nil, err
+	}
+	if int64(frames) > maxFrames {
+		return nil, fmt.Errorf("animation too large (over %d frames of %dx%d)", maxFrames, canvas.Width, canvas.Height)
+	}
+	if frames < 2 {
+		return nil, nil
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return gif.DecodeAll(file)
+}
+
+// A srcset for high-DPI screens: the thumbnail at 2x and 3x, if those sizes
+// are allowed. Empty if neither is
+func ThumbnailSrcset(config *Config, imgslug string) string {
+	return imageSrcset(config, fmt.Sprintf("%s/thumbnails/%s", config.RootPath, imgslug))
+}
+
+// The 2x and 3x candidates for an image url (which may already have a query)
+func imageSrcset(config *Config, imageUrl string) string {
+	separator := "?"
+	if strings.Contains(imageUrl, "?") {
+		separator = "&"
+	}
+	candidates := make([]string, 0)
+	for _, scale := range []int{2, 3} {
+		if size := config.ThumbnailSize * scale; config.AllowedImageSize(size) {
+			candidates = append(candidates, fmt.Sprintf("%s%ssize=%d %dx", imageUrl, separator, size, scale))
+		}
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// Remove temp files left behind by thumbnails that never finished (crashes,
+// etc). Only ones older than maxAge go, since another process (a server, the
+// warm command) may be using the same folder right now
+func CleanThumbnailTemps(folder string, maxAge time.Duration) error {
+	leftovers, err := filepath.Glob(filepath.Join(folder, ThumbnailTempPattern))
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, f := range leftovers {
+		stat, err := os.Stat(f)
+		if err != nil || stat.ModTime().After(cutoff) {
+			continue // Already gone or still being written
+		}
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type thumbnailFailure struct {
+	err     error
+	expires time.Time
+}
+
+// Remember uploads that can't be thumbnailed (missing, not images, too big) so
+// we don't try again on every request. Other errors might go away on their own
+func (gctx *GonContext) rememberThumbnailFailure(imgslug string, err error) {
+	var badRequest *utils.BadRequest
+	var notFound *utils.NotFound
+	if !errors.As(err, &badRequest) && !errors.As(err, &notFound) {
+		return
+	}
+	gctx.thumbnailFailures.Store(imgslug, &thumbnailFailure{
+		err:     err,
+		expires: time.Now().Add(time.Duration(gctx.Config().ThumbnailFailureTime)),
+	})
+}
+
+// The icon (path in the static files) to show instead of a thumbnail for
+// uploads that aren't images we can thumbnail. Picked by the mime type
+// contentapi recorded, or by looking at the file if there isn't one
+func (gctx *GonContext) ThumbnailPlaceholder(imgslug string) string {
+	mimeType, err := gctx.GetUploadMimeType(imgslug)
+	if err != nil {
+		log.Printf("WARN: couldn't get mime type for %s: %s", imgslug, err)
+	}
+	return fmt.Sprintf("icons/%s.svg", utils.MimeFamily(mimeType))
+}
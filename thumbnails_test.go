@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+func TestThumbnailPlaceholder(t *testing.T) {
+	gctx := newTestContext(t)
+	var zipped bytes.Buffer
+	zipper := zip.NewWriter(&zipped)
+	zipper.Create("inside.txt")
+	zipper.Close()
+	addTestUpload(t, gctx, "recorded", "notes.txt", "text/plain", []byte("hello"))
+	addTestUpload(t, gctx, "sniffed", "stuff.zip", "", zipped.Bytes())
+	addTestUpload(t, gctx, "audio", "song.mp3", "audio/mpeg", []byte("not really"))
+	addTestUpload(t, gctx, "unknown", "thing.bin", "", []byte{0, 1, 2, 3})
+
+	for hash, expected := range map[string]string{
+		"recorded": "icons/text.svg",
+		"sniffed":  "icons/archive.svg",
+		"audio":    "icons/audio.svg",
+		"unknown":  "icons/file.svg",
+		"missing":  "icons/file.svg",
+	} {
+		if placeholder := gctx.ThumbnailPlaceholder(hash); placeholder != expected {
+			t.Fatalf("Expected %s placeholder to be %s, got %s", hash, expected, placeholder)
+		}
+		// And it has to actually exist
+		if _, err := fs.Stat(gctx.staticfs, expected); err != nil {
+			t.Fatalf("Placeholder %s missing: %s", expected, err)
+		}
+	}
+}
+
+func TestThumbnailFailureCache(t *testing.T) {
+	gctx := newTestContext(t)
+	addTestUpload(t, gctx, "later", "later.png", "image/png", []byte("not an image yet"))
+
+	_, err := gctx.OpenThumbnail("later")
+	var badRequest *utils.BadRequest
+	if !errors.As(err, &badRequest) {
+		t.Fatalf("Expected bad request for a non-image, got %v", err)
+	}
+
+	// Fixing the upload doesn't help until the failure expires
+	err = os.WriteFile(filepath.Join(gctx.Config().Uploads, "later"), testPng(t, 20, 20), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gctx.OpenThumbnail("later")
+	if !errors.As(err, &badRequest) {
+		t.Fatalf("Expected the failure to be remembered, got %v", err)
+	}
+
+	failure, ok := gctx.thumbnailFailures.Load("later")
+	if !ok {
+		t.Fatalf("Expected a failure stored")
+	}
+	failure.(*thumbnailFailure).expires = time.Now().Add(-time.Second)
+	file, err := gctx.OpenThumbnail("later")
+	if err != nil {
+		t.Fatalf("Expected thumbnail after the failure expired, got %s", err)
+	}
+	file.Close()
+	if _, ok := gctx.thumbnailFailures.Load("later"); ok {
+		t.Fatalf("Expected the expired failure to be forgotten")
+	}
+
+	// Other errors aren't remembered, they might go away
+	gctx.rememberThumbnailFailure("other", errors.New("disk on fire"))
+	if _, ok := gctx.thumbnailFailures.Load("other"); ok {
+		t.Fatalf("Expected unexpected errors not to be remembered")
+	}
+}
+
+func TestServeImagePlaceholders(t *testing.T) {
+	gctx := newTestContext(t)
+	gctx.Config().ThumbnailMaxPixels = 30 * 30
+	addTestUpload(t, gctx, "small", "small.png", "image/png", testPng(t, 20, 20))
+	addTestUpload(t, gctx, "huge", "huge.png", "image/png", testPng(t, 40, 40))
+	addTestUpload(t, gctx, "words", "words.txt", "text/plain", []byte("just text"))
+
+	icon := func(name string) []byte {
+		data, err := fs.ReadFile(gctx.staticfs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	for hash, expected := range map[string][]byte{
+		"huge":  icon("icons/image.svg"), // Over the pixel limit
+		"words": icon("icons/text.svg"),
+	} {
+		rec := httptest.NewRecorder()
+		gctx.ServeImage(rec, httptest.NewRequest("GET", "/thumbnails/"+hash, nil), hash, gctx.ThumbnailOptions())
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected placeholder for %s, got %d: %s", hash, rec.Code, rec.Body)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), expected) {
+			t.Fatalf("Wrong placeholder for %s", hash)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	gctx.ServeImage(rec, httptest.NewRequest("GET", "/thumbnails/small", nil), "small", gctx.ThumbnailOptions())
+	// Opaque, so it's a jpeg
+	if rec.Code != http.StatusOK || !bytes.HasPrefix(rec.Body.Bytes(), []byte("\xff\xd8")) {
+		t.Fatalf("Expected a real thumbnail for a small image, got %d", rec.Code)
+	}
+
+	// Missing uploads are still a 404, not a placeholder
+	rec = httptest.NewRecorder()
+	gctx.ServeImage(rec, httptest.NewRequest("GET", "/thumbnails/nope", nil), "nope", gctx.ThumbnailOptions())
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing upload, got %d", rec.Code)
+	}
+}
+
+func testGif(t *testing.T, frames int) []byte {
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{Config: image.Config{ColorModel: palette, Width: 4, Height: 4}}
+	for i := range frames {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		frame.Pix[0] = uint8(i % 2)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 5)
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, animation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAnimationLimits(t *testing.T) {
+	gctx := newTestContext(t)
+	gctx.Config().ThumbnailMaxFrames = 5 // So at most 50 frames
+	addTestUpload(t, gctx, "fine", "fine.gif", "image/gif", testGif(t, 40))
+	addTestUpload(t, gctx, "toomany", "toomany.gif", "image/gif", testGif(t, 60))
+	addTestUpload(t, gctx, "toobig", "toobig.gif", "image/gif", testGif(t, 30))
+
+	file, err := gctx.OpenThumbnail("fine")
+	if err != nil {
+		t.Fatalf("Expected animated thumbnail, got %s", err)
+	}
+	animation, err := gif.DecodeAll(file)
+	file.Close()
+	if err != nil || len(animation.Image) != 5 {
+		t.Fatalf("Expected 5 sampled frames, got %v", err)
+	}
+
+	var badRequest *utils.BadRequest
+	if _, err := gctx.OpenThumbnail("toomany"); !errors.As(err, &badRequest) {
+		t.Fatalf("Expected too many frames to be rejected, got %v", err)
+	}
+	// 30 frames of 16 pixels is over 400
+	gctx.Config().ThumbnailMaxPixels = 400
+	if _, err := gctx.OpenThumbnail("toobig"); !errors.As(err, &badRequest) {
+		t.Fatalf("Expected too many pixels to be rejected, got %v", err)
+	}
+}
+
+func TestThumbnailBiggerThanCache(t *testing.T) {
+	gctx := newTestContext(t)
+	// Every thumbnail is over this on its own
+	gctx.thumbnailCache.SetLimit(100)
+	addTestUpload(t, gctx, "first", "first.png", "image/png", testPng(t, 20, 20))
+	addTestUpload(t, gctx, "second", "second.png", "image/png", testPng(t, 30, 30))
+
+	for _, hash := range []string{"first", "second", "first"} {
+		rec := httptest.NewRecorder()
+		gctx.ServeImage(rec, httptest.NewRequest("GET", "/thumbnails/"+hash, nil), hash, gctx.ThumbnailOptions())
+		if rec.Code != http.StatusOK || !bytes.HasPrefix(rec.Body.Bytes(), []byte("\xff\xd8")) {
+			t.Fatalf("Expected a thumbnail for %s even over the cache limit, got %d: %s", hash, rec.Code, rec.Body)
+		}
+	}
+	// Only the newest one is kept
+	entries, err := os.ReadDir(gctx.Config().ThumbnailFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected just the newest thumbnail kept, got %d files", len(entries))
+	}
+}
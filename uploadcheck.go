@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+// Orphans modified more recently than this might be uploads whose row isn't
+// written yet, so they're never quarantined
+const OrphanMinAge = time.Hour
+
+// A file content row, for checking against the disk
+type uploadRow struct {
+	Id       int64  `db:"id"`
+	Hash     string `db:"hash"`
+	Name     string `db:"name"`
+	Deleted  bool   `db:"deleted"`
+	MimeType string `db:"mimeType"`
+}
+
+// Something wrong with a single upload
+type UploadProblem struct {
+	ContentId int64  `json:"contentId,omitempty"` // 0 for orphans
+	Hash      string `json:"hash"`
+	Name      string `json:"name,omitempty"`
+	MimeType  string `json:"mimeType,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Everything wrong between the database and the uploads folder
+type UploadCheckReport struct {
+	Uploads     int             `json:"uploads"`     // File rows that aren't deleted
+	Files       int             `json:"files"`       // Files in the uploads folder
+	Missing     []UploadProblem `json:"missing"`     // Rows with no file
+	Orphans     []UploadProblem `json:"orphans"`     // Files with no row (deleted rows still count as a row)
+	Empty       []UploadProblem `json:"empty"`       // Zero byte files
+	Undecodable []UploadProblem `json:"undecodable"` // Images that won't decode
+	Quarantined []string        `json:"quarantined,omitempty"`
+}
+
+// How many problems were found in total
+func (report *UploadCheckReport) ProblemCount() int {
+	return len(report.Missing) + len(report.Orphans) + len(report.Empty) + len(report.Undecodable)
+}
+
+// Cross reference every file content row with the uploads folder. Images
+// (by their recorded type, or by sniffing if there isn't one) are fully
+// decoded unless decode is false, ThumbnailWorkers at a time. Images over
+// ThumbnailMaxPixels only have their header checked
+func (gctx *GonContext) CheckUploads(decode bool) (*UploadCheckReport, error) {
+	config := gctx.Config()
+	rows := make([]uploadRow, 0)
+	err := gctx.contentdb.Select(&rows, "SELECT c.id, c.hash, c.name, c.deleted, COALESCE(v.value, '') AS mimeType FROM content c "+
+		"LEFT JOIN content_values v ON v.contentId = c.id AND v.key = 'mimeType' "+
+		"WHERE c.contentType = ? ORDER BY c.id", contentapi.ContentType_File)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(config.Uploads)
+	if err != nil {
+		return nil, err
+	}
+
+	report := UploadCheckReport{
+		Missing:     make([]UploadProblem, 0),
+		Orphans:     make([]UploadProblem, 0),
+		Empty:       make([]UploadProblem, 0),
+		Undecodable: make([]UploadProblem, 0),
+	}
+	files := make(map[string]int64)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = info.Size()
+	}
+	report.Files = len(files)
+
+	referenced := make(map[string]struct{})
+	toDecode := make([]UploadProblem, 0)
+	for _, row := range rows {
+		referenced[row.Hash] = struct{}{}
+		if row.Deleted {
+			continue
+		}
+		report.Uploads++
+		problem := UploadProblem{ContentId: row.Id, Hash: row.Hash, Name: row.Name, MimeType: contentapi.DecodeValue(row.MimeType)}
+		size, ok := files[row.Hash]
+		if !ok {
+			report.Missing = append(report.Missing, problem)
+			continue
+		}
+		problem.Bytes = size
+		if size == 0 {
+			report.Empty = append(report.Empty, problem)
+			continue
+		}
+		if decode {
+			toDecode = append(toDecode, problem)
+		}
+	}
+	for name, size := range files {
+		if _, ok := referenced[name]; ok {
+			continue
+		}
+		// Uploaded after we read the rows, so not actually an orphan
+		recorded, err := gctx.uploadRecorded(name)
+		if err != nil {
+			return nil, err
+		}
+		if !recorded {
+			report.Orphans = append(report.Orphans, UploadProblem{Hash: name, Bytes: size})
+		}
+	}
+	sort.Slice(report.Orphans, func(i, j int) bool { return report.Orphans[i].Hash < report.Orphans[j].Hash })
+
+	// Decoding is the slow part
+	jobs := make(chan UploadProblem)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var failure error
+	for range config.ThumbnailWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for problem := range jobs {
+				broken, err := gctx.checkUploadDecodes(problem.Hash, problem.MimeType)
+				lock.Lock()
+				if err != nil && failure == nil {
+					failure = fmt.Errorf("%s: %w", problem.Hash, err)
+				}
+				if broken != "" {
+					problem.Error = broken
+					report.Undecodable = append(report.Undecodable, problem)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, problem := range toDecode {
+		jobs <- problem
+	}
+	close(jobs)
+	wg.Wait()
+	if failure != nil {
+		return nil, failure
+	}
+	sort.Slice(report.Undecodable, func(i, j int) bool { return report.Undecodable[i].ContentId < report.Undecodable[j].ContentId })
+	return &report, nil
+}
+
+// If the upload is an image, see if it actually decodes. Returns what's wrong
+// with the image (empty if it's fine or not an image); errors are for when we
+// couldn't even check
+func (gctx *GonContext) checkUploadDecodes(imgslug string, mimeType string) (string, error) {
+	file, err := os.Open(filepath.Join(gctx.Config().Uploads, imgslug))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+		mimeType, err = utils.SniffMimeType(file)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !utils.DecodableImageType(mimeType) {
+		return "", nil
+	}
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err.Error(), nil
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels <= 0 {
+		return fmt.Sprintf("Image has no pixels (%dx%d)", config.Width, config.Height), nil
+	}
+	// Too big to decode here, but the header at least makes sense
+	if pixels > int64(gctx.Config().ThumbnailMaxPixels) {
+		return "", nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	_, _, err = image.Decode(file)
+	if err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
+
+// Whether there's a content row (deleted or not) for the given file
+func (gctx *GonContext) uploadRecorded(hash string) (bool, error) {
+	var count int
+	err := gctx.contentdb.Get(&count, "SELECT COUNT(*) FROM content WHERE hash = ?", hash)
+	return count > 0, err
+}
+
+// Move the orphans from the report into the given folder (keeping their
+// names), recording which ones were moved. Each one is checked again first:
+// anything that got a content row since the report or was modified in the
+// last OrphanMinAge is left alone. Files already in the quarantine are never
+// overwritten
+func (gctx *GonContext) QuarantineOrphans(report *UploadCheckReport, folder string) error {
+	err := os.MkdirAll(folder, 0750)
+	if err != nil {
+		return err
+	}
+	for _, orphan := range report.Orphans {
+		from := filepath.Join(gctx.Config().Uploads, orphan.Hash)
+		to := filepath.Join(folder, orphan.Hash)
+		stat, err := os.Stat(from)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // Someone else dealt with it
+			}
+			return err
+		}
+		if time.Since(stat.ModTime()) < OrphanMinAge {
+			log.Printf("Not quarantining %s, it was only just modified", orphan.Hash)
+			continue
+		}
+		recorded, err := gctx.uploadRecorded(orphan.Hash)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			log.Printf("Not quarantining %s, it has a content row now", orphan.Hash)
+			continue
+		}
+		if _, err := os.Lstat(to); err == nil {
+			return fmt.Errorf("%s is already in the quarantine", orphan.Hash)
+		}
+		err = moveFile(from, to)
+		if err != nil {
+			return err
+		}
+		report.Quarantined = append(report.Quarantined, orphan.Hash)
+	}
+	return nil
+}
+
+// Rename, or copy and delete if the folders are on different drives
+func moveFile(from string, to string) error {
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+)
+
+func TestCheckUploads(t *testing.T) {
+	gctx := newTestContext(t)
+	uploads := gctx.Config().Uploads
+	addTestUpload(t, gctx, "good", "good.png", "image/png", testPng(t, 10, 10))
+	addTestUpload(t, gctx, "gone", "gone.png", "image/png", testPng(t, 10, 10))
+	os.Remove(filepath.Join(uploads, "gone"))
+	addTestUpload(t, gctx, "empty", "empty.txt", "text/plain", []byte{})
+	addTestUpload(t, gctx, "broken", "broken.png", "image/png", []byte("not a png at all"))
+	addTestUpload(t, gctx, "notes", "notes.txt", "text/plain", []byte("not an image, that's fine"))
+	addTestUpload(t, gctx, "deleted", "deleted.png", "image/png", testPng(t, 10, 10))
+	_, err := gctx.contentdb.Exec("UPDATE content SET deleted = 1 WHERE hash = 'deleted'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * OrphanMinAge)
+	for _, name := range []string{"orphan", "late", "recent", "zclash"} {
+		path := filepath.Join(uploads, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "recent" {
+			os.Chtimes(path, old, old)
+		}
+	}
+
+	report, err := gctx.CheckUploads(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := func(problems []UploadProblem) []string {
+		result := make([]string, 0)
+		for _, p := range problems {
+			result = append(result, p.Hash)
+		}
+		return result
+	}
+	for _, c := range []struct {
+		name     string
+		found    []UploadProblem
+		expected []string
+	}{
+		{"missing", report.Missing, []string{"gone"}},
+		{"orphans", report.Orphans, []string{"late", "orphan", "recent", "zclash"}},
+		{"empty", report.Empty, []string{"empty"}},
+		{"undecodable", report.Undecodable, []string{"broken"}},
+	} {
+		if !slices.Equal(hashes(c.found), c.expected) {
+			t.Fatalf("Expected %s %v, got %v", c.name, c.expected, hashes(c.found))
+		}
+	}
+	if report.Uploads != 5 || report.Files != 9 || report.ProblemCount() != 7 {
+		t.Fatalf("Wrong totals: %d uploads, %d files, %d problems", report.Uploads, report.Files, report.ProblemCount())
+	}
+	// Without decoding, broken images aren't found
+	quick, err := gctx.CheckUploads(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quick.Undecodable) != 0 {
+		t.Fatalf("Expected no decoding, got %v", hashes(quick.Undecodable))
+	}
+
+	// "late" is recorded after the report, like an upload finishing mid check
+	_, err = gctx.contentdb.Exec("INSERT INTO content (createDate, createUserId, name, contentType, hash) VALUES ('2020-01-01T00:00:00', 1, 'late', ?, 'late')",
+		contentapi.ContentType_File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	os.MkdirAll(quarantine, 0750)
+	err = os.WriteFile(filepath.Join(quarantine, "zclash"), []byte("already here"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gctx.QuarantineOrphans(report, quarantine); err == nil {
+		t.Fatalf("Expected an error quarantining over an existing file")
+	}
+	if !slices.Equal(report.Quarantined, []string{"orphan"}) {
+		t.Fatalf("Expected just the real old orphan moved, got %v", report.Quarantined)
+	}
+	for name, inUploads := range map[string]bool{"orphan": false, "late": true, "recent": true, "zclash": true} {
+		_, err := os.Stat(filepath.Join(uploads, name))
+		if (err == nil) != inUploads {
+			t.Fatalf("Expected %s in uploads: %t, got %v", name, inUploads, err)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(quarantine, "zclash")); string(data) != "already here" {
+		t.Fatalf("Quarantine overwrote an existing file")
+	}
+	if data, _ := os.ReadFile(filepath.Join(quarantine, "orphan")); string(data) != "orphan" {
+		t.Fatalf("Orphan didn't make it to the quarantine")
+	}
+}
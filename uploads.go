@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+const (
+	ActiveUploads_Sandbox  = "sandbox"  // Shown in the browser, but without scripts, forms, etc
+	ActiveUploads_Download = "download" // Always downloaded, never shown
+)
+
+// Content security policy sent with every upload. It can show itself (and
+// images) and nothing else; plain images and media don't notice
+const UploadSandboxPolicy = "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'"
+
+// What contentapi recorded about an upload
+type UploadInfo struct {
+	Name     string `db:"name"`     // Usually the original file name
+	MimeType string `db:"mimeType"` // Empty if it wasn't recorded
+}
+
+// Look up the name and mime type recorded for an upload. Uploads with no
+// content row (shouldn't happen, but) just get empty info
+func (gctx *GonContext) GetUploadInfo(imgslug string) (*UploadInfo, error) {
+	var info UploadInfo
+	err := gctx.contentdb.Get(&info, "SELECT c.name, COALESCE(v.value, '') AS mimeType FROM content c "+
+		"LEFT JOIN content_values v ON v.contentId = c.id AND v.key = 'mimeType' "+
+		"WHERE c.hash = ? AND c.contentType = ?", imgslug, contentapi.ContentType_File)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	info.MimeType = contentapi.DecodeValue(info.MimeType)
+	return &info, nil
+}
+
+// The mime type of an upload: what contentapi recorded when it was uploaded,
+// otherwise a guess from the file contents. Empty if neither works
+func (gctx *GonContext) GetUploadMimeType(imgslug string) (string, error) {
+	info, err := gctx.GetUploadInfo(imgslug)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := mime.ParseMediaType(info.MimeType); err == nil {
+		return info.MimeType, nil
+	}
+	file, err := os.Open(filepath.Join(gctx.Config().Uploads, imgslug))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer file.Close()
+	return utils.SniffMimeType(file)
+}
+
+// Whether the given mime type is something browsers only ever display (see
+// InlineUploadTypes). Svg and other xml types can always run scripts, so they
+// never are, whatever the config says
+func (config *Config) IsPassiveUploadType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "/xml") {
+		return false
+	}
+	return slices.ContainsFunc(config.InlineUploadTypes, func(t string) bool {
+		t = strings.ToLower(t)
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			return strings.HasPrefix(mediaType, prefix+"/")
+		}
+		return t == mediaType
+	})
+}
+
+// Serve the original upload with the type it was uploaded as and its original
+// name. Uploads live on our own origin, so everything is sandboxed, anything
+// that isn't a known passive type (html, svg, etc) can be forced to download,
+// and browsers are told not to second guess the type. With StripUploadLocation,
+// jpegs are only ever served without their location data, or not at all
+func (gctx *GonContext) ServeUpload(w http.ResponseWriter, r *http.Request, imgslug string) {
+	config := gctx.Config()
+	file, err := os.Open(filepath.Join(config.Uploads, imgslug))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = &utils.NotFound{Message: fmt.Sprintf("No upload %s", imgslug)}
+		}
+		handleError(err, w)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if handleError(err, w) {
+		return
+	}
+	info, err := gctx.GetUploadInfo(imgslug)
+	if handleError(err, w) {
+		return
+	}
+	mimeType := info.MimeType
+	if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+		mimeType, err = utils.SniffMimeType(file)
+		if handleError(err, w) {
+			return
+		}
+	}
+	name := info.Name
+	if name == "" {
+		name = imgslug
+	}
+
+	var content io.ReadSeeker = file
+	if config.StripUploadLocation && isJpeg(mimeType) {
+		// Never fall back to the original, that's exactly what we're hiding
+		stripped, err := gctx.OpenStrippedUpload(imgslug)
+		if err != nil {
+			handleError(fmt.Errorf("couldn't strip location from %s: %w", imgslug, err), w)
+			return
+		}
+		defer stripped.Close()
+		content = stripped
+	}
+
+	disposition := "inline"
+	if !config.IsPassiveUploadType(mimeType) && config.ActiveUploads == ActiveUploads_Download {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Security-Policy", UploadSandboxPolicy)
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", utils.DefaultCacheControl)
+	http.ServeContent(w, r, name, stat.ModTime(), content)
+}
+
+func isJpeg(mimeType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	return mediaType == "image/jpeg" || mediaType == "image/pjpeg"
+}
+
+// The name of an upload's copy without location data in the thumbnail folder
+func strippedUploadName(imgslug string) string {
+	return imgslug + "-noloc.jpg"
+}
+
+// Open a copy of the given jpeg upload without its location data, making it
+// first if it doesn't exist or the upload changed. Copies live with the
+// thumbnails (and count towards ThumbnailCacheLimit), so they're only made
+// once, and they're streamed to disk, so size doesn't matter. You must close
+// the file when done
+func (gctx *GonContext) OpenStrippedUpload(imgslug string) (*os.File, error) {
+	cacheName := strippedUploadName(imgslug)
+	path := filepath.Join(gctx.Config().ThumbnailFolder, cacheName)
+	// Usually once; again if someone else made it and it was evicted before we
+	// could open it (see OpenImage)
+	for attempt := 0; ; attempt++ {
+		file, err := os.Open(path)
+		if err == nil {
+			if gctx.imageFresh(imgslug, file) {
+				gctx.thumbnailCache.Touch(cacheName)
+				return file, nil
+			}
+			file.Close()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		var made *os.File
+		err = gctx.thumbnailFlight.Do(cacheName, func() error {
+			// Someone may have JUST finished it between our open and now
+			if file, err := os.Open(path); err == nil {
+				fresh := gctx.imageFresh(imgslug, file)
+				file.Close()
+				if fresh {
+					return nil
+				}
+			}
+			upload, err := os.Open(filepath.Join(gctx.Config().Uploads, imgslug))
+			if err != nil {
+				return err
+			}
+			defer upload.Close()
+			made, err = gctx.writeCacheFile(path, func(w io.Writer) error {
+				return utils.StripJpegLocation(w, upload)
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		// We made it, so we already have it open (it might be evicted by now)
+		if made != nil {
+			return made, nil
+		}
+		file, err = os.Open(path)
+		if err == nil || !os.IsNotExist(err) || attempt > 0 {
+			return file, err
+		}
+	}
+}
+
+// What we know about an upload's file. The image fields are empty for
+// anything that isn't an image we can read
+type UploadMeta struct {
+	Hash     string `json:"hash"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Bytes    int64  `json:"bytes"`
+	Format   string `json:"format,omitempty"` // What the image actually is (jpeg, png, gif, etc)
+	Width    int    `json:"width,omitempty"`  // As displayed, so sideways photos are swapped
+	Height   int    `json:"height,omitempty"`
+}
+
+// Look up the size and dimensions of an upload. Only the image header is
+// read, so this is cheap even for huge images
+func (gctx *GonContext) GetUploadMeta(imgslug string) (*UploadMeta, error) {
+	file, err := os.Open(filepath.Join(gctx.Config().Uploads, imgslug))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &utils.NotFound{Message: fmt.Sprintf("No upload %s", imgslug)}
+		}
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info, err := gctx.GetUploadInfo(imgslug)
+	if err != nil {
+		return nil, err
+	}
+	meta := UploadMeta{
+		Hash:     imgslug,
+		Name:     info.Name,
+		MimeType: info.MimeType,
+		Bytes:    stat.Size(),
+	}
+	if _, _, err := mime.ParseMediaType(meta.MimeType); err != nil {
+		meta.MimeType, err = utils.SniffMimeType(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	imgconfig, format, err := image.DecodeConfig(file)
+	if err != nil {
+		// Not an image (or not one we know), which is fine
+		return &meta, nil
+	}
+	meta.Format = format
+	meta.Width = imgconfig.Width
+	meta.Height = imgconfig.Height
+	if format == "jpeg" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if utils.OrientationSwapsSize(utils.JpegOrientation(file)) {
+			meta.Width, meta.Height = meta.Height, meta.Width
+		}
+	}
+	return &meta, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+func TestServeUploadHeaders(t *testing.T) {
+	gctx := newTestContext(t)
+	addTestUpload(t, gctx, "page", "page.html", "text/html", []byte("<script>alert(1)</script>"))
+	addTestUpload(t, gctx, "drawing", "drawing.svg", "image/svg+xml", []byte("<svg><script>alert(1)</script></svg>"))
+	addTestUpload(t, gctx, "feed", "feed.rss", "application/rss+xml", []byte("<rss></rss>"))
+	addTestUpload(t, gctx, "picture", "picture.png", "image/png", testPng(t, 4, 4))
+
+	serve := func(hash string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		gctx.ServeUpload(rec, httptest.NewRequest("GET", "/uploads/"+hash, nil), hash)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %s to be served, got %d: %s", hash, rec.Code, rec.Body)
+		}
+		return rec
+	}
+
+	for _, mode := range []string{ActiveUploads_Sandbox, ActiveUploads_Download} {
+		gctx.Config().ActiveUploads = mode
+		for hash, expected := range map[string]string{
+			"page":    `inline; filename=page.html`,
+			"drawing": `inline; filename=drawing.svg`,
+			"feed":    `inline; filename=feed.rss`,
+			"picture": `inline; filename=picture.png`,
+		} {
+			if mode == ActiveUploads_Download && hash != "picture" {
+				expected = "attachment" + expected[len("inline"):]
+			}
+			rec := serve(hash)
+			if disposition := rec.Header().Get("Content-Disposition"); disposition != expected {
+				t.Fatalf("Expected %s disposition %q in %s mode, got %q", hash, expected, mode, disposition)
+			}
+			// Always, even for images
+			if csp := rec.Header().Get("Content-Security-Policy"); csp != UploadSandboxPolicy {
+				t.Fatalf("Expected %s to be sandboxed in %s mode, got %q", hash, mode, csp)
+			}
+			if nosniff := rec.Header().Get("X-Content-Type-Options"); nosniff != "nosniff" {
+				t.Fatalf("Expected nosniff for %s, got %q", hash, nosniff)
+			}
+		}
+	}
+
+	// Svg and xml never count as passive, even if someone lists them
+	gctx.Config().InlineUploadTypes = []string{"image/*", "application/*"}
+	rec := serve("drawing")
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != "attachment; filename=drawing.svg" {
+		t.Fatalf("Expected svg to still download, got %q", disposition)
+	}
+	rec = serve("feed")
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != "attachment; filename=feed.rss" {
+		t.Fatalf("Expected rss to still download, got %q", disposition)
+	}
+}
+
+// A jpeg with location data in its XMP (the exif side is tested in utils)
+func testJpegWithLocation(t *testing.T) []byte {
+	var plain bytes.Buffer
+	err := jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 40, 20)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmp := []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>exif:GPSLatitude</x:xmpmeta>")
+	var result bytes.Buffer
+	result.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(&result, binary.BigEndian, uint16(len(xmp)+2))
+	result.Write(xmp)
+	result.Write(plain.Bytes()[2:])
+	return result.Bytes()
+}
+
+func TestServeUploadStripsLocation(t *testing.T) {
+	gctx := newTestContext(t)
+	original := testJpegWithLocation(t)
+	addTestUpload(t, gctx, "photo", "photo.jpg", "image/jpeg", original)
+
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/uploads/photo", nil)
+		if rangeHeader != "" {
+			request.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		gctx.ServeUpload(rec, request, "photo")
+		return rec
+	}
+
+	rec := get("")
+	stripped := rec.Body.Bytes()
+	if rec.Code != http.StatusOK || bytes.Contains(stripped, []byte("GPSLatitude")) {
+		t.Fatalf("Expected the location stripped, got %d", rec.Code)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatalf("Stripped jpeg doesn't decode: %s", err)
+	}
+	// Made once and kept with the thumbnails
+	cached := filepath.Join(gctx.Config().ThumbnailFolder, strippedUploadName("photo"))
+	if _, err := os.Stat(cached); err != nil {
+		t.Fatalf("Expected a cached stripped copy: %s", err)
+	}
+
+	rec = get("bytes=2-9")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), stripped[2:10]) {
+		t.Fatalf("Expected a range of the stripped jpeg, got %d", rec.Code)
+	}
+
+	// A replaced upload gets a new copy
+	replaced := testPlainJpeg(t)
+	err := os.WriteFile(filepath.Join(gctx.Config().Uploads, "photo"), replaced, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(gctx.Config().Uploads, "photo"), later, later)
+	if rec = get(""); !bytes.Equal(rec.Body.Bytes(), replaced) {
+		t.Fatalf("Expected the replaced upload, got the old one")
+	}
+
+	gctx.Config().StripUploadLocation = false
+	os.WriteFile(filepath.Join(gctx.Config().Uploads, "photo"), original, 0644)
+	if rec = get(""); !bytes.Equal(rec.Body.Bytes(), original) {
+		t.Fatalf("Expected the original with stripping off")
+	}
+}
+
+func TestServeUploadNeverLeaksLocation(t *testing.T) {
+	gctx := newTestContext(t)
+	original := testJpegWithLocation(t)
+	addTestUpload(t, gctx, "photo", "photo.jpg", "image/jpeg", original)
+	addTestUpload(t, gctx, "other", "other.jpg", "image/jpeg", original)
+	// Cut off in the middle of the XMP, just after the location
+	cut := bytes.Index(original, []byte("GPSLatitude")) + len("GPSLatitude") + 1
+	addTestUpload(t, gctx, "broken", "broken.jpg", "image/jpeg", original[:cut])
+
+	get := func(hash string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		gctx.ServeUpload(rec, httptest.NewRequest("GET", "/uploads/"+hash, nil), hash)
+		if bytes.Contains(rec.Body.Bytes(), []byte("GPSLatitude")) {
+			t.Fatalf("Location leaked for %s (status %d)", hash, rec.Code)
+		}
+		return rec
+	}
+
+	// Every stripped copy is over the limit on its own, so they keep evicting
+	// each other
+	gctx.thumbnailCache.SetLimit(100)
+	for _, hash := range []string{"photo", "other", "photo", "other"} {
+		if rec := get(hash); rec.Code != http.StatusOK {
+			t.Fatalf("Expected %s served over the cache limit, got %d", hash, rec.Code)
+		}
+	}
+
+	rec := get("broken")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected an error for a jpeg that can't be stripped, got %d", rec.Code)
+	}
+	if rec.Header().Get("Cache-Control") == utils.DefaultCacheControl {
+		t.Fatalf("Errors shouldn't be cached like uploads")
+	}
+}
+
+// A plain jpeg with nothing to strip
+func testPlainJpeg(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -1,9 +1,13 @@
 package utils
 
 import (
+	"encoding"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -56,3 +60,176 @@ func ReadConfigStack(basename string, apply func(string, []byte) error, maxRead
 	}
 	return results, nil
 }
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// The names of all settable fields in a config struct, in order
+func ConfigFieldNames(config any) []string {
+	t := reflect.TypeOf(config).Elem()
+	names := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		if t.Field(i).IsExported() {
+			names = append(names, t.Field(i).Name)
+		}
+	}
+	return names
+}
+
+// Set a single field in a config struct (given as a pointer) by name, parsing
+// the raw value the same way the config file would
+func SetConfigField(config any, name string, raw string) error {
+	field := reflect.ValueOf(config).Elem().FieldByName(name)
+	if !field.IsValid() || !field.CanSet() {
+		return fmt.Errorf("unknown config field %s", name)
+	}
+	return setConfigValue(field, name, raw)
+}
+
+func setConfigValue(field reflect.Value, name string, raw string) error {
+	if field.Addr().Type().Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(x)
+	case reflect.Bool:
+		x, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(x)
+	case reflect.Slice:
+		// Lists are comma separated, ex: 50,100,200
+		values := make([]string, 0)
+		for _, v := range strings.Split(raw, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, v := range values {
+			if err := setConfigValue(slice.Index(i), name, v); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("config field %s can't be set from text", name)
+	}
+	return nil
+}
+
+// The environment variable that overrides the given field, ex: PREFIX_THUMBNAILSIZE
+func ConfigEnvName(prefix string, name string) string {
+	return prefix + "_" + strings.ToUpper(name)
+}
+
+// Apply PREFIX_FIELD environment variables (looked up with the given function,
+// usually os.LookupEnv) to the config. Returns the variables that were used
+func ApplyConfigEnv(config any, prefix string, lookup func(string) (string, bool)) ([]string, error) {
+	used := make([]string, 0)
+	for _, name := range ConfigFieldNames(config) {
+		envname := ConfigEnvName(prefix, name)
+		raw, ok := lookup(envname)
+		if !ok {
+			continue
+		}
+		err := SetConfigField(config, name, raw)
+		if err != nil {
+			return used, fmt.Errorf("%s: %w", envname, err)
+		}
+		used = append(used, envname)
+	}
+	return used, nil
+}
+
+// Whether a config field holds something that shouldn't be printed
+func IsSecretConfigField(name string) bool {
+	lower := strings.ToLower(name)
+	for _, s := range []string{"password", "secret", "token", "apikey", "privatekey"} {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Make a copy of the config (given as a pointer) with all secret string
+// fields replaced, safe for printing
+func RedactConfig(config any) any {
+	copied := reflect.New(reflect.TypeOf(config).Elem())
+	copied.Elem().Set(reflect.ValueOf(config).Elem())
+	for _, name := range ConfigFieldNames(config) {
+		field := copied.Elem().FieldByName(name)
+		if IsSecretConfigField(name) && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString("REDACTED")
+		}
+	}
+	return copied.Interface()
+}
+
+// Every problem found with a config, reported together so they can all be
+// fixed in one go
+type ConfigProblems struct {
+	Problems []string
+}
+
+func (e *ConfigProblems) Error() string {
+	return fmt.Sprintf("%d config problem(s):\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// Edit distance between two strings (case insensitive)
+func EditDistance(a string, b string) int {
+	ar, br := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(br)]
+}
+
+// Find the option closest to the given (probably typo'd) name, or "" if
+// nothing is reasonably close
+func ClosestMatch(name string, options []string) string {
+	best, bestDistance := "", len(name)/2+2
+	for _, o := range options {
+		if d := EditDistance(name, o); d < bestDistance {
+			best, bestDistance = o, d
+		}
+	}
+	return best
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Address  string
+	Timeout  Duration
+	Size     int
+	Enabled  bool
+	Password string
+	Sizes    []int
+}
+
+func TestApplyConfigEnv(t *testing.T) {
+	config := testConfig{Address: ":5030", Size: 100, Password: "hunter2"}
+	env := map[string]string{
+		"TEST_TIMEOUT": "1m",
+		"TEST_SIZE":    "200",
+		"TEST_ENABLED": "true",
+		"TEST_SIZES":   "50, 100,200",
+	}
+	used, err := ApplyConfigEnv(&config, "TEST", func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatalf("Error applying env: %s", err)
+	}
+	if len(used) != 4 {
+		t.Fatalf("Expected 4 env variables used, got %v", used)
+	}
+	if config.Address != ":5030" || time.Duration(config.Timeout) != time.Minute || config.Size != 200 || !config.Enabled ||
+		!slices.Equal(config.Sizes, []int{50, 100, 200}) {
+		t.Fatalf("Bad config after env: %v", config)
+	}
+
+	env["TEST_SIZE"] = "big"
+	_, err = ApplyConfigEnv(&config, "TEST", func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err == nil {
+		t.Fatalf("Expected error for bad int")
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	config := testConfig{Address: ":5030", Password: "hunter2"}
+	redacted := RedactConfig(&config).(*testConfig)
+	if redacted.Password != "REDACTED" || redacted.Address != ":5030" {
+		t.Fatalf("Bad redaction: %v", redacted)
+	}
+	if config.Password != "hunter2" {
+		t.Fatalf("Redaction modified the original config")
+	}
+}
+
+func TestClosestMatch(t *testing.T) {
+	options := []string{"Address", "Templates", "ThumbnailSize", "ThumbnailFolder"}
+	tests := map[string]string{
+		"Adress":        "Address",
+		"templates":     "Templates",
+		"ThumbnailSzie": "ThumbnailSize",
+		"Nothing":       "",
+	}
+	for in, expected := range tests {
+		if match := ClosestMatch(in, options); match != expected {
+			t.Fatalf("Expected closest match of %s to be %q, got %q", in, expected, match)
+		}
+	}
+}
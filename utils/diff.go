@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// Past this many cells in the lcs table, we just say everything changed.
+	// Cells are 4 bytes, so this is at most 16MB per diff
+	MaxDiffCells = 4000000
+)
+
+type DiffOp int
+
+const (
+	DiffEqual DiffOp = iota
+	DiffDelete
+	DiffInsert
+)
+
+// A run of text which is either the same, removed, or added
+type DiffPart struct {
+	Op   DiffOp
+	Text string
+}
+
+func (d DiffPart) IsEqual() bool  { return d.Op == DiffEqual }
+func (d DiffPart) IsDelete() bool { return d.Op == DiffDelete }
+func (d DiffPart) IsInsert() bool { return d.Op == DiffInsert }
+
+// Collects diff tokens, merging runs of the same op. The tokens in a run are
+// only joined at the end, so a long run isn't copied once per token
+type diffBuilder struct {
+	ops  []DiffOp
+	runs [][]string
+}
+
+// Add a token to the diff, merging with the previous run if it's the same op
+func (d *diffBuilder) add(op DiffOp, token string) {
+	if len(d.ops) > 0 && d.ops[len(d.ops)-1] == op {
+		d.runs[len(d.runs)-1] = append(d.runs[len(d.runs)-1], token)
+		return
+	}
+	d.ops = append(d.ops, op)
+	d.runs = append(d.runs, []string{token})
+}
+
+func (d *diffBuilder) parts() []DiffPart {
+	parts := make([]DiffPart, len(d.ops))
+	for i, op := range d.ops {
+		parts[i] = DiffPart{Op: op, Text: strings.Join(d.runs[i], "")}
+	}
+	return parts
+}
+
+// Compute the diff between two lists of tokens using a plain longest common
+// subsequence. It's not the fastest, but page text isn't that big
+func Diff(a []string, b []string) []DiffPart {
+	var diff diffBuilder
+
+	// Common prefix and suffix don't need to be in the table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		diff.add(DiffEqual, a[prefix])
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma := a[prefix : len(a)-suffix]
+	mb := b[prefix : len(b)-suffix]
+
+	if len(ma)*len(mb) > MaxDiffCells {
+		// Too big, just say the whole middle was replaced
+		for _, t := range ma {
+			diff.add(DiffDelete, t)
+		}
+		for _, t := range mb {
+			diff.add(DiffInsert, t)
+		}
+	} else {
+		// lcs[i][j] is the lcs length of ma[i:] and mb[j:]
+		w := len(mb) + 1
+		lcs := make([]int32, (len(ma)+1)*w)
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+				} else {
+					lcs[i*w+j] = max(lcs[(i+1)*w+j], lcs[i*w+j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) && j < len(mb) {
+			if ma[i] == mb[j] {
+				diff.add(DiffEqual, ma[i])
+				i++
+				j++
+			} else if lcs[(i+1)*w+j] >= lcs[i*w+j+1] {
+				diff.add(DiffDelete, ma[i])
+				i++
+			} else {
+				diff.add(DiffInsert, mb[j])
+				j++
+			}
+		}
+		for ; i < len(ma); i++ {
+			diff.add(DiffDelete, ma[i])
+		}
+		for ; j < len(mb); j++ {
+			diff.add(DiffInsert, mb[j])
+		}
+	}
+
+	for _, t := range a[len(a)-suffix:] {
+		diff.add(DiffEqual, t)
+	}
+
+	return diff.parts()
+}
+
+// Split text into lines, keeping the newlines so the diff can be rejoined
+func SplitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.SplitAfter(text, "\n")
+}
+
+// Split text into words and the whitespace between them, so that joining
+// the result gives back the original text
+func SplitWords(text string) []string {
+	result := make([]string, 0)
+	start := 0
+	var lastSpace bool
+	for i, r := range text {
+		space := unicode.IsSpace(r)
+		if i > start && space != lastSpace {
+			result = append(result, text[start:i])
+			start = i
+		}
+		lastSpace = space
+	}
+	if start < len(text) {
+		result = append(result, text[start:])
+	}
+	return result
+}
+
+// Diff two texts line by line
+func DiffLines(a string, b string) []DiffPart {
+	return Diff(SplitLines(a), SplitLines(b))
+}
+
+// Diff two texts word by word (whitespace is kept as its own token)
+func DiffWords(a string, b string) []DiffPart {
+	return Diff(SplitWords(a), SplitWords(b))
+}
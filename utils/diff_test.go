@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+// Rebuild the old and new text from a diff
+func rebuildDiff(parts []DiffPart) (string, string) {
+	var a, b strings.Builder
+	for _, p := range parts {
+		if p.Op != DiffInsert {
+			a.WriteString(p.Text)
+		}
+		if p.Op != DiffDelete {
+			b.WriteString(p.Text)
+		}
+	}
+	return a.String(), b.String()
+}
+
+func TestSplitWords(t *testing.T) {
+	words := SplitWords("  hello there\n friend")
+	expected := []string{"  ", "hello", " ", "there", "\n ", "friend"}
+	if len(words) != len(expected) {
+		t.Fatalf("Expected %d words, got %d: %q", len(expected), len(words), words)
+	}
+	for i := range words {
+		if words[i] != expected[i] {
+			t.Fatalf("Expected word %d to be %q, got %q", i, expected[i], words[i])
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	a := "one\ntwo\nthree\nfour"
+	b := "one\nthree\nthree and a half\nfour"
+	parts := DiffLines(a, b)
+	ra, rb := rebuildDiff(parts)
+	if ra != a || rb != b {
+		t.Fatalf("Diff didn't rebuild: %q, %q", ra, rb)
+	}
+	if len(parts) != 5 {
+		t.Fatalf("Expected 5 parts, got %d: %v", len(parts), parts)
+	}
+	if !parts[1].IsDelete() || parts[1].Text != "two\n" {
+		t.Fatalf("Expected 'two' to be deleted, got %v", parts[1])
+	}
+	if !parts[3].IsInsert() || parts[3].Text != "three and a half\n" {
+		t.Fatalf("Expected 'three and a half' to be inserted, got %v", parts[3])
+	}
+}
+
+func TestDiffWords(t *testing.T) {
+	a := "the quick brown fox"
+	b := "the slow brown dog"
+	parts := DiffWords(a, b)
+	ra, rb := rebuildDiff(parts)
+	if ra != a || rb != b {
+		t.Fatalf("Diff didn't rebuild: %q, %q", ra, rb)
+	}
+	for _, p := range parts {
+		if p.IsEqual() && strings.Contains(p.Text, "quick") {
+			t.Fatalf("'quick' should not be equal: %v", parts)
+		}
+	}
+}
+
+func TestDiffEmpty(t *testing.T) {
+	parts := DiffLines("", "new\ntext")
+	if len(parts) != 1 || !parts[0].IsInsert() {
+		t.Fatalf("Expected a single insert, got %v", parts)
+	}
+	parts = DiffLines("same", "same")
+	if len(parts) != 1 || !parts[0].IsEqual() {
+		t.Fatalf("Expected a single equal, got %v", parts)
+	}
+}
+
+func TestDiffRewritten(t *testing.T) {
+	// Over MaxDiffCells, so the whole thing is one delete and one insert
+	a := strings.Repeat("old\n", 3000) + "end"
+	b := strings.Repeat("new\n", 3000) + "fin"
+	parts := DiffLines(a, b)
+	if len(parts) != 2 || !parts[0].IsDelete() || !parts[1].IsInsert() {
+		t.Fatalf("Expected one delete and one insert, got %d parts", len(parts))
+	}
+	if ra, rb := rebuildDiff(parts); ra != a || rb != b {
+		t.Fatalf("Diff didn't rebuild")
+	}
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"cmp"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps a folder of cached files under a size limit by deleting the least
+// recently used ones. Usage is tracked in memory (starting from the file
+// modification times), so touching a file on every hit is cheap and lock free
+type DiskLRU struct {
+	folder   string
+	limit    atomic.Int64 // Bytes, 0 means no limit
+	total    atomic.Int64
+	entries  sync.Map // name -> *diskLRUEntry
+	evicting sync.Mutex
+}
+
+type diskLRUEntry struct {
+	size int64
+	used atomic.Int64 // Unix nanoseconds
+}
+
+// Start tracking the files already in the given folder. Anything matching
+// skip (a glob pattern, ex: temp files) is ignored
+func NewDiskLRU(folder string, limit int64, skip string) (*DiskLRU, error) {
+	lru := &DiskLRU{folder: folder}
+	lru.limit.Store(limit)
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if matched, _ := filepath.Match(skip, e.Name()); matched {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		lru.track(e.Name(), info.Size(), info.ModTime())
+	}
+	return lru, nil
+}
+
+func (lru *DiskLRU) track(name string, size int64, used time.Time) {
+	entry := &diskLRUEntry{size: size}
+	entry.used.Store(used.UnixNano())
+	if old, loaded := lru.entries.Swap(name, entry); loaded {
+		lru.total.Add(-old.(*diskLRUEntry).size)
+	}
+	lru.total.Add(size)
+}
+
+// Change the size limit (bytes, 0 for none). Takes effect on the next Evict
+func (lru *DiskLRU) SetLimit(limit int64) {
+	lru.limit.Store(limit)
+}
+
+// Total bytes of all tracked files
+func (lru *DiskLRU) Size() int64 {
+	return lru.total.Load()
+}
+
+// Mark the file as just used
+func (lru *DiskLRU) Touch(name string) {
+	if entry, ok := lru.entries.Load(name); ok {
+		entry.(*diskLRUEntry).used.Store(time.Now().UnixNano())
+	}
+}
+
+// Track a new (or replaced) file and evict old ones if we're over the limit.
+// The new file itself is never evicted here, even if it's over the limit on
+// its own; whoever made it is about to use it
+func (lru *DiskLRU) Add(name string, size int64) error {
+	lru.track(name, size, time.Now())
+	_, err := lru.evict(name)
+	return err
+}
+
+// Delete the file and stop tracking it
+func (lru *DiskLRU) Remove(name string) error {
+	if entry, loaded := lru.entries.LoadAndDelete(name); loaded {
+		lru.total.Add(-entry.(*diskLRUEntry).size)
+	}
+	err := os.Remove(filepath.Join(lru.folder, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// If we're over the limit, delete the least recently used files until we're
+// 10% under it (so we're not evicting on every single add). Returns how many
+// were deleted
+func (lru *DiskLRU) Evict() (int, error) {
+	return lru.evict("")
+}
+
+// Evict, but never the given file
+func (lru *DiskLRU) evict(keep string) (int, error) {
+	limit := lru.limit.Load()
+	if limit <= 0 || lru.total.Load() <= limit {
+		return 0, nil
+	}
+	// Only one eviction at a time; anyone else can just skip it
+	if !lru.evicting.TryLock() {
+		return 0, nil
+	}
+	defer lru.evicting.Unlock()
+
+	type candidate struct {
+		name string
+		used int64
+	}
+	candidates := make([]candidate, 0)
+	lru.entries.Range(func(key, value any) bool {
+		if key.(string) != keep {
+			candidates = append(candidates, candidate{key.(string), value.(*diskLRUEntry).used.Load()})
+		}
+		return true
+	})
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(a.used, b.used)
+	})
+	target := limit - limit/10
+	removed := 0
+	for _, c := range candidates {
+		if lru.total.Load() <= target {
+			break
+		}
+		if err := lru.Remove(c.name); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskLRU(t *testing.T) {
+	folder := t.TempDir()
+	write := func(name string, age time.Duration) {
+		path := filepath.Join(folder, name)
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-age)
+		os.Chtimes(path, old, old)
+	}
+	write("a", 3*time.Hour)
+	write("b", 2*time.Hour)
+	write("c", time.Hour)
+	write(".tmp-1", 4*time.Hour)
+
+	lru, err := NewDiskLRU(folder, 350, ".tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lru.Size() != 300 {
+		t.Fatalf("Expected 300 bytes tracked, got %d", lru.Size())
+	}
+	// Using "a" makes "b" the oldest
+	lru.Touch("a")
+	write("d", 0)
+	if err := lru.Add("d", 100); err != nil {
+		t.Fatal(err)
+	}
+	// 400 is over 350, so evict down to 315: just b goes
+	for name, exists := range map[string]bool{"a": true, "b": false, "c": true, "d": true, ".tmp-1": true} {
+		_, err := os.Stat(filepath.Join(folder, name))
+		if (err == nil) != exists {
+			t.Fatalf("Expected %s to exist: %t, got error %v", name, exists, err)
+		}
+	}
+	if lru.Size() != 300 {
+		t.Fatalf("Expected 300 bytes after eviction, got %d", lru.Size())
+	}
+
+	// No limit, no eviction
+	lru.SetLimit(0)
+	write("e", 0)
+	lru.Add("e", 100)
+	if lru.Size() != 400 {
+		t.Fatalf("Expected 400 bytes with no limit, got %d", lru.Size())
+	}
+
+	// A single file over the limit pushes everything else out, but stays itself
+	lru.SetLimit(150)
+	write("huge", 0)
+	if err := lru.Add("huge", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "huge")); err != nil {
+		t.Fatalf("Expected the file being added to survive its own eviction: %s", err)
+	}
+	if lru.Size() != 1000 {
+		t.Fatalf("Expected only the huge file left, got %d bytes", lru.Size())
+	}
+	// Until something else is added
+	write("f", 0)
+	lru.Add("f", 100)
+	if _, err := os.Stat(filepath.Join(folder, "huge")); err == nil {
+		t.Fatalf("Expected the huge file to go once it isn't the newest")
+	}
+}
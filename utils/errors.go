@@ -17,3 +17,11 @@ type NotFound struct {
 func (e *NotFound) Error() string {
 	return e.Message
 }
+
+type Forbidden struct {
+	Message string
+}
+
+func (e *Forbidden) Error() string {
+	return e.Message
+}
@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	exifTagOrientation = 0x0112
+	exifTagGpsIfd      = 0x8825
+)
+
+var (
+	exifHeader        = []byte("Exif\x00\x00")
+	xmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// A jpeg marker segment (not including the image data after SOS)
+type jpegSegment struct {
+	marker byte
+	data   []byte // Everything after the length
+}
+
+// Split a jpeg into its segments and the rest (starting at SOS, the actual
+// image). On errors, the segments read so far are still returned
+func splitJpeg(data []byte) ([]jpegSegment, []byte, error) {
+	segments := make([]jpegSegment, 0)
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return segments, nil, errors.New("not a jpeg")
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return segments, nil, errors.New("bad jpeg marker")
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return segments, data[pos:], nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return segments, nil, errors.New("bad jpeg segment length")
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: data[pos+4 : pos+2+length]})
+		pos += 2 + length
+	}
+	return segments, nil, errors.New("jpeg ended early")
+}
+
+// A parsed tiff structure (what exif is) that can be edited in place
+type tiffData struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func parseTiff(data []byte) (*tiffData, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, errors.New("exif too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, 0, errors.New("bad exif header")
+	}
+	return &tiffData{data: data, order: order}, order.Uint32(data[4:]), nil
+}
+
+// Call fn with the offset of every entry in the IFD at the given offset
+func (t *tiffData) entries(ifd uint32, fn func(entry int)) error {
+	if int(ifd)+2 > len(t.data) {
+		return errors.New("exif ifd out of range")
+	}
+	count := int(t.order.Uint16(t.data[ifd:]))
+	if int(ifd)+2+count*12 > len(t.data) {
+		return errors.New("exif ifd entries out of range")
+	}
+	for i := range count {
+		fn(int(ifd) + 2 + i*12)
+	}
+	return nil
+}
+
+// The size of an entry's value, in bytes
+func (t *tiffData) valueSize(entry int) int {
+	sizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+	return sizes[t.order.Uint16(t.data[entry+2:])] * int(t.order.Uint32(t.data[entry+4:]))
+}
+
+// Find the exif segment in a jpeg, if there is one
+func jpegExif(segments []jpegSegment) []byte {
+	for _, s := range segments {
+		if s.marker == 0xE1 && bytes.HasPrefix(s.data, exifHeader) {
+			return s.data[len(exifHeader):]
+		}
+	}
+	return nil
+}
+
+// Read the exif orientation (1-8) of a jpeg. Anything without one (or that
+// isn't a jpeg) is 1, meaning "already the right way up"
+func JpegOrientation(r io.Reader) int {
+	// The exif is always near the start
+	data, err := io.ReadAll(io.LimitReader(r, 256*1024))
+	if err != nil {
+		return 1
+	}
+	// We probably don't have the whole image, but the segments before it are enough
+	segments, _, _ := splitJpeg(data)
+	exif := jpegExif(segments)
+	if exif == nil {
+		return 1
+	}
+	tiff, ifd0, err := parseTiff(exif)
+	if err != nil {
+		return 1
+	}
+	orientation := 1
+	tiff.entries(ifd0, func(entry int) {
+		if tiff.order.Uint16(tiff.data[entry:]) == exifTagOrientation {
+			orientation = int(tiff.order.Uint16(tiff.data[entry+8:]))
+		}
+	})
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// Turn an image the right way up according to its exif orientation
+func Orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// Whether the orientation turns the image sideways (so width and height swap)
+func OrientationSwapsSize(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// Copy a jpeg without its location data: the exif GPS block is emptied and
+// XMP (which can also have it) is dropped. Everything else in the exif, like
+// the orientation, is kept. If the exif can't be understood it's all dropped,
+// better safe than sorry. Only one segment is held at a time, the image data
+// itself is just copied. On errors, w has whatever was written so far
+func StripJpegLocation(w io.Writer, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header[:2]); err != nil || header[0] != 0xFF || header[1] != 0xD8 {
+		return errors.New("not a jpeg")
+	}
+	if _, err := w.Write(header[:2]); err != nil {
+		return err
+	}
+	for {
+		if _, err := io.ReadFull(reader, header[:2]); err != nil {
+			return errors.New("jpeg ended early")
+		}
+		if header[0] != 0xFF {
+			return errors.New("bad jpeg marker")
+		}
+		marker := header[1]
+		if marker == 0xDA || marker == 0xD9 {
+			if _, err := w.Write(header[:2]); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, reader)
+			return err
+		}
+		if _, err := io.ReadFull(reader, header[2:]); err != nil {
+			return errors.New("jpeg ended early")
+		}
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return errors.New("bad jpeg segment length")
+		}
+		data := make([]byte, length-2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return errors.New("jpeg ended early")
+		}
+		if marker == 0xE1 {
+			if bytes.HasPrefix(data, xmpHeader) || bytes.HasPrefix(data, xmpExtendedHeader) {
+				continue
+			}
+			if bytes.HasPrefix(data, exifHeader) && stripExifGps(data[len(exifHeader):]) != nil {
+				continue
+			}
+		}
+		// Stripping the GPS never changes the length
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// Empty the GPS IFD (entries and their values) in place
+func stripExifGps(exif []byte) error {
+	tiff, ifd0, err := parseTiff(exif)
+	if err != nil {
+		return err
+	}
+	var gpsIfd uint32
+	err = tiff.entries(ifd0, func(entry int) {
+		if tiff.order.Uint16(tiff.data[entry:]) == exifTagGpsIfd {
+			gpsIfd = tiff.order.Uint32(tiff.data[entry+8:])
+		}
+	})
+	if err != nil || gpsIfd == 0 {
+		return err
+	}
+	var badValue bool
+	err = tiff.entries(gpsIfd, func(entry int) {
+		if size := tiff.valueSize(entry); size > 4 {
+			offset := int(tiff.order.Uint32(tiff.data[entry+8:]))
+			if offset+size > len(tiff.data) {
+				badValue = true
+				return
+			}
+			clear(tiff.data[offset : offset+size])
+		}
+		clear(tiff.data[entry : entry+12])
+	})
+	if err != nil {
+		return err
+	}
+	if badValue {
+		return errors.New("exif gps value out of range")
+	}
+	// No entries; the (now zeroed) bytes after it read as "no next IFD"
+	tiff.order.PutUint16(tiff.data[gpsIfd:], 0)
+	return nil
+}
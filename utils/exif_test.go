@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"testing"
+)
+
+var testLatitude = []byte{0, 0, 0, 51, 0, 0, 0, 1, 0, 0, 0, 30, 0, 0, 0, 1, 0, 0, 0, 15, 0, 0, 0, 1}
+
+// A jpeg with exif (orientation and GPS) and XMP, like phones make
+func fixtureJpeg(t *testing.T, orientation uint16) []byte {
+	var plain bytes.Buffer
+	err := jpeg.Encode(&plain, fixtureImage(40, 20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Big endian tiff: IFD0 at 8 with orientation and the GPS pointer, GPS IFD
+	// at 38 with latitude ref (inline) and latitude (3 rationals at 68)
+	var tiff bytes.Buffer
+	be := binary.BigEndian
+	tiff.WriteString("MM\x00*")
+	binary.Write(&tiff, be, uint32(8))
+	binary.Write(&tiff, be, uint16(2))
+	binary.Write(&tiff, be, []uint16{exifTagOrientation, 3})
+	binary.Write(&tiff, be, uint32(1))
+	binary.Write(&tiff, be, []uint16{orientation, 0})
+	binary.Write(&tiff, be, []uint16{exifTagGpsIfd, 4})
+	binary.Write(&tiff, be, []uint32{1, 38})
+	binary.Write(&tiff, be, uint32(0))
+	binary.Write(&tiff, be, uint16(2))
+	binary.Write(&tiff, be, []uint16{1, 2})
+	binary.Write(&tiff, be, uint32(2))
+	tiff.WriteString("N\x00\x00\x00")
+	binary.Write(&tiff, be, []uint16{2, 5})
+	binary.Write(&tiff, be, []uint32{3, 68})
+	binary.Write(&tiff, be, uint32(0))
+	tiff.Write(testLatitude)
+
+	segment := func(out *bytes.Buffer, marker byte, data []byte) {
+		out.Write([]byte{0xFF, marker})
+		binary.Write(out, be, uint16(len(data)+2))
+		out.Write(data)
+	}
+	var result bytes.Buffer
+	result.Write([]byte{0xFF, 0xD8})
+	segment(&result, 0xE1, append([]byte("Exif\x00\x00"), tiff.Bytes()...))
+	segment(&result, 0xE1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), []byte("<x:xmpmeta>exif:GPSLatitude</x:xmpmeta>")...))
+	result.Write(plain.Bytes()[2:])
+	return result.Bytes()
+}
+
+func TestJpegOrientation(t *testing.T) {
+	if o := JpegOrientation(bytes.NewReader(fixtureJpeg(t, 6))); o != 6 {
+		t.Fatalf("Expected orientation 6, got %d", o)
+	}
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, fixtureImage(4, 4), nil)
+	if o := JpegOrientation(&plain); o != 1 {
+		t.Fatalf("Expected orientation 1 without exif, got %d", o)
+	}
+	if o := JpegOrientation(bytes.NewReader([]byte("not a jpeg"))); o != 1 {
+		t.Fatalf("Expected orientation 1 for garbage, got %d", o)
+	}
+	// Sideways images come out with width and height swapped
+	rotated := Orient(fixtureImage(40, 20), 6)
+	if rotated.Bounds() != image.Rect(0, 0, 20, 40) || !OrientationSwapsSize(6) {
+		t.Fatalf("Expected 20x40 after orientation 6, got %v", rotated.Bounds())
+	}
+}
+
+func TestStripJpegLocation(t *testing.T) {
+	var result bytes.Buffer
+	err := StripJpegLocation(&result, bytes.NewReader(fixtureJpeg(t, 6)))
+	if err != nil {
+		t.Fatalf("Error stripping: %s", err)
+	}
+	stripped := result.Bytes()
+	if bytes.Contains(stripped, testLatitude) {
+		t.Fatalf("Latitude still in stripped jpeg")
+	}
+	if bytes.Contains(stripped, []byte("GPSLatitude")) {
+		t.Fatalf("XMP still in stripped jpeg")
+	}
+	if o := JpegOrientation(bytes.NewReader(stripped)); o != 6 {
+		t.Fatalf("Expected orientation kept, got %d", o)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil || img.Bounds().Dx() != 40 {
+		t.Fatalf("Stripped jpeg doesn't decode: %v", err)
+	}
+	if err := StripJpegLocation(io.Discard, bytes.NewReader([]byte("not a jpeg"))); err == nil {
+		t.Fatalf("Expected error stripping garbage")
+	}
+	// Cut off in the middle of a segment
+	if err := StripJpegLocation(io.Discard, bytes.NewReader(fixtureJpeg(t, 6)[:30])); err == nil {
+		t.Fatalf("Expected error stripping a truncated jpeg")
+	}
+}
@@ -0,0 +1,51 @@
+package utils
+
+import "sync"
+
+// Makes sure only one call for a given key runs at a time. Anyone asking for
+// the same key while it's running waits and gets the same result instead of
+// running it again (like x/sync/singleflight, minus the values)
+type FlightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// Run fn for the key, or wait for the call already running for it
+func (g *FlightGroup) Do(key string, fn func() error) error {
+	g.lock.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.lock.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.flights, key)
+		g.lock.Unlock()
+		close(f.done)
+	}()
+	f.err = fn()
+	return f.err
+}
+
+// Limits how many things run at once. Acquire blocks until there's room
+type Limiter chan struct{}
+
+func NewLimiter(count int) Limiter {
+	return make(Limiter, max(count, 1))
+}
+
+func (l Limiter) Acquire() { l <- struct{}{} }
+func (l Limiter) Release() { <-l }
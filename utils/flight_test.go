@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var group FlightGroup
+	var calls atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			group.Do("a", func() error {
+				calls.Add(1)
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			})
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("Expected 1 call for the same key, got %d", calls.Load())
+	}
+	// Once it's done, the next call runs again
+	group.Do("a", func() error { calls.Add(1); return nil })
+	if calls.Load() != 2 {
+		t.Fatalf("Expected a new call after the first finished, got %d", calls.Load())
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(2)
+	var running, most atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.Acquire()
+			defer limiter.Release()
+			now := running.Add(1)
+			for {
+				old := most.Load()
+				if now <= old || most.CompareAndSwap(old, now) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+	if most.Load() > 2 {
+		t.Fatalf("Expected at most 2 at once, got %d", most.Load())
+	}
+}
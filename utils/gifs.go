@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// Resize every frame of an animated gif. Gif frames are often just the part
+// that changed, so each one is drawn over the frames before it first and the
+// result is full frames. If there are more than maxFrames, frames are skipped
+// evenly (adding their delays to the ones kept) so it still plays at the same speed
+func ResizeGif(g *gif.GIF, maxFrames int, resize func(image.Image) image.Image) *gif.GIF {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	step := 1
+	if maxFrames > 0 && len(g.Image) > maxFrames {
+		step = (len(g.Image) + maxFrames - 1) / maxFrames
+	}
+
+	result := &gif.GIF{LoopCount: g.LoopCount}
+	canvas := image.NewNRGBA(bounds)
+	delay := 0
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewNRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if i < len(g.Delay) {
+			delay += g.Delay[i]
+		}
+
+		if i%step == step-1 || i == len(g.Image)-1 {
+			resized := resize(canvas)
+			result.Image = append(result.Image, toPaletted(resized, frame.Palette))
+			result.Delay = append(result.Delay, delay)
+			result.Disposal = append(result.Disposal, gif.DisposalNone)
+			delay = 0
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	if len(result.Image) > 0 {
+		result.Config = image.Config{
+			ColorModel: result.Image[0].Palette,
+			Width:      result.Image[0].Bounds().Dx(),
+			Height:     result.Image[0].Bounds().Dy(),
+		}
+	}
+	return result
+}
+
+// Turn a resized frame back into a paletted one using the original frame's
+// colors (plus transparent, if it had any transparency)
+func toPaletted(img image.Image, original color.Palette) *image.Paletted {
+	palette := make(color.Palette, 0, len(original)+1)
+	hasTransparent := false
+	for _, c := range original {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			hasTransparent = true
+		}
+		palette = append(palette, c)
+	}
+	if !hasTransparent && !IsOpaque(img) && len(palette) < 256 {
+		palette = append(palette, color.Transparent)
+	}
+	result := image.NewPaletted(img.Bounds(), palette)
+	draw.FloydSteinberg.Draw(result, img.Bounds(), img, img.Bounds().Min)
+	return result
+}
+
+// Whether every pixel in the image is fully opaque. Images that can't say are
+// checked pixel by pixel
+func IsOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Count the frames in a gif without decoding any of them (just skipping over
+// the blocks), stopping once there are more than limit. Use this before
+// gif.DecodeAll, which allocates every frame before you can check anything
+func CountGifFrames(r io.Reader, limit int) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, errors.New("not a gif")
+	}
+	// Global color table
+	if err := skipGifColorTable(br, header[10]); err != nil {
+		return 0, err
+	}
+	frames := 0
+	for frames <= limit {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return frames, err
+		}
+		switch kind {
+		case 0x21: // Extension: label, then data blocks
+			if _, err := br.ReadByte(); err != nil {
+				return frames, err
+			}
+			if err := skipGifBlocks(br); err != nil {
+				return frames, err
+			}
+		case 0x2C: // Image: descriptor, color table, lzw code size, then data blocks
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return frames, err
+			}
+			if err := skipGifColorTable(br, descriptor[8]); err != nil {
+				return frames, err
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return frames, err
+			}
+			if err := skipGifBlocks(br); err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3B: // Trailer
+			return frames, nil
+		default:
+			return frames, errors.New("bad gif block")
+		}
+	}
+	return frames, nil
+}
+
+func skipGifColorTable(br *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := br.Discard(3 << ((flags & 0x07) + 1))
+	return err
+}
+
+// Skip a run of sub-blocks (each a length byte then that much data) up to the empty one
+func skipGifBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// An animated gif where every frame after the first only covers part of the image
+func fixtureGif(frames int) *gif.GIF {
+	palette := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}, color.Transparent}
+	result := &gif.GIF{Config: image.Config{ColorModel: palette, Width: 40, Height: 20}}
+	for i := range frames {
+		rect := image.Rect(0, 0, 40, 20)
+		if i > 0 {
+			rect = image.Rect(i%40, 0, i%40+1, 20)
+		}
+		frame := image.NewPaletted(rect, palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % 3)
+		}
+		result.Image = append(result.Image, frame)
+		result.Delay = append(result.Delay, 10)
+		result.Disposal = append(result.Disposal, gif.DisposalNone)
+	}
+	return result
+}
+
+func TestResizeGif(t *testing.T) {
+	half := func(img image.Image) image.Image { return imaging.Resize(img, 20, 10, imaging.Lanczos) }
+
+	resized := ResizeGif(fixtureGif(5), 100, half)
+	if len(resized.Image) != 5 {
+		t.Fatalf("Expected 5 frames, got %d", len(resized.Image))
+	}
+	for i, frame := range resized.Image {
+		if frame.Bounds() != image.Rect(0, 0, 20, 10) || resized.Delay[i] != 10 {
+			t.Fatalf("Frame %d wrong: %v delay %d", i, frame.Bounds(), resized.Delay[i])
+		}
+	}
+	// It has to survive an encode/decode round trip to be any use
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, resized); err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	decoded, err := gif.DecodeAll(&buf)
+	if err != nil || len(decoded.Image) != 5 {
+		t.Fatalf("Bad round trip: %v", err)
+	}
+
+	// Too many frames: every other one is dropped but it takes the same time
+	capped := ResizeGif(fixtureGif(10), 5, half)
+	total := 0
+	for _, d := range capped.Delay {
+		total += d
+	}
+	if len(capped.Image) != 5 || total != 100 {
+		t.Fatalf("Expected 5 frames totalling 100, got %d totalling %d", len(capped.Image), total)
+	}
+}
+
+func TestIsOpaque(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for p := range img.Pix {
+		img.Pix[p] = 255
+	}
+	if !IsOpaque(img) {
+		t.Fatalf("Expected opaque image")
+	}
+	img.SetNRGBA(1, 1, color.NRGBA{0, 0, 0, 0})
+	if IsOpaque(img) {
+		t.Fatalf("Expected transparent image")
+	}
+	// Survives png (which is how uploads come in)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	decoded, _ := png.Decode(&buf)
+	if IsOpaque(decoded) {
+		t.Fatalf("Expected decoded png to be transparent")
+	}
+}
+
+func TestCountGifFrames(t *testing.T) {
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, fixtureGif(25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err := CountGifFrames(bytes.NewReader(buf.Bytes()), 1000)
+	if err != nil || frames != 25 {
+		t.Fatalf("Expected 25 frames, got %d (%v)", frames, err)
+	}
+	// Stops as soon as it's over the limit
+	frames, err = CountGifFrames(bytes.NewReader(buf.Bytes()), 10)
+	if err != nil || frames != 11 {
+		t.Fatalf("Expected to stop at 11 frames, got %d (%v)", frames, err)
+	}
+	if _, err := CountGifFrames(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), 1000); err == nil {
+		t.Fatalf("Expected error for a truncated gif")
+	}
+	if _, err := CountGifFrames(bytes.NewReader([]byte("PNG not a gif")), 1000); err == nil {
+		t.Fatalf("Expected error for a non-gif")
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"io/fs"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -74,6 +75,11 @@ func FileServer(r chi.Router, path string, local string, listdir bool) error {
 	return nil
 }
 
+// Serve files from any filesystem (embedded, layered, etc)
+func FileServerFS(r chi.Router, path string, fsys fs.FS, listdir bool) {
+	FileServerRaw(r, path, http.FS(fsys), listdir)
+}
+
 func RespondPlaintext(data []byte, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	_, err := w.Write(data)
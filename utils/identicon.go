@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Make a github style identicon: a symmetric 5x5 grid of blocks in one color,
+// both picked from the hash of the seed. The same seed always gives the same
+// picture, so it works as a default avatar
+func Identicon(seed []byte, size int) image.Image {
+	hash := sha1.Sum(seed)
+	foreground := hslColor(float64(hash[0])/255*360, 0.45+float64(hash[1])/255*0.2, 0.5+float64(hash[2])/255*0.15)
+	background := color.NRGBA{240, 240, 240, 255}
+
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	// Leave a margin of half a block around the grid
+	block := float64(size) / 6
+	margin := block / 2
+	for row := range 5 {
+		for col := range 3 {
+			// 15 bits for the left half plus middle column, mirrored to the right
+			if hash[3+row*3+col]&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, 4 - col} {
+				rect := image.Rect(
+					int(margin+float64(c)*block), int(margin+float64(row)*block),
+					int(margin+float64(c+1)*block), int(margin+float64(row+1)*block))
+				draw.Draw(img, rect, image.NewUniform(foreground), image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+// Convert hue (0-360), saturation and lightness (0-1) to a color
+func hslColor(h, s, l float64) color.NRGBA {
+	c := (1 - abs(2*l-1)) * s
+	hp := h / 60
+	x := c * (1 - abs(mod(hp, 2)-1))
+	var r, g, b float64
+	switch {
+	case hp < 1:
+		r, g = c, x
+	case hp < 2:
+		r, g = x, c
+	case hp < 3:
+		g, b = c, x
+	case hp < 4:
+		g, b = x, c
+	case hp < 5:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := l - c/2
+	return color.NRGBA{uint8((r + m) * 255), uint8((g + m) * 255), uint8((b + m) * 255), 255}
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func mod(x, y float64) float64 {
+	return x - y*float64(int(x/y))
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"image"
+	"testing"
+)
+
+func TestIdenticon(t *testing.T) {
+	a := Identicon([]byte("1"), 60).(*image.NRGBA)
+	a2 := Identicon([]byte("1"), 60).(*image.NRGBA)
+	b := Identicon([]byte("2"), 60).(*image.NRGBA)
+	if a.Bounds().Dx() != 60 || a.Bounds().Dy() != 60 {
+		t.Fatalf("Expected 60x60, got %v", a.Bounds())
+	}
+	if string(a.Pix) != string(a2.Pix) {
+		t.Fatalf("Same seed gave different identicons")
+	}
+	if string(a.Pix) == string(b.Pix) {
+		t.Fatalf("Different seeds gave the same identicon")
+	}
+	// Left and right mirror each other
+	for y := range 60 {
+		for x := range 30 {
+			if a.NRGBAAt(x, y) != a.NRGBAAt(59-x, y) {
+				t.Fatalf("Not symmetric at %d,%d", x, y)
+			}
+		}
+	}
+}
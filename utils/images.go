@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Decode an image, but check its size first so a tiny file claiming to be
+// 100000x100000 can't eat all our memory. Anything that isn't an image we
+// understand or is over maxPixels is a BadRequest
+func DecodeImageLimited(r io.ReadSeeker, maxPixels int64) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", &BadRequest{Message: fmt.Sprintf("Not an image: %s", err)}
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels <= 0 {
+		return nil, "", &BadRequest{Message: fmt.Sprintf("Image has no pixels (%dx%d)", config.Width, config.Height)}
+	}
+	if pixels > maxPixels {
+		return nil, "", &BadRequest{Message: fmt.Sprintf("Image too large (%dx%d, limit %d pixels)", config.Width, config.Height, maxPixels)}
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", &BadRequest{Message: fmt.Sprintf("Broken %s image: %s", format, err)}
+	}
+	return img, format, nil
+}
+
+// Guess the mime type of a file from its first few bytes
+func SniffMimeType(r io.ReadSeeker) (string, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return http.DetectContentType(header[:n]), nil
+}
+
+// Sort a mime type into a broad family for picking icons: image, audio, video,
+// text, archive or file (everything else)
+func MimeFamily(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "file"
+	}
+	major, minor, _ := strings.Cut(mediaType, "/")
+	switch major {
+	case "image", "audio", "video", "text":
+		return major
+	}
+	switch minor {
+	case "zip", "gzip", "x-gzip", "x-tar", "x-7z-compressed", "x-rar-compressed", "vnd.rar", "x-bzip2", "x-xz", "zstd":
+		return "archive"
+	case "json", "xml", "javascript", "x-javascript":
+		return "text"
+	case "ogg":
+		return "audio"
+	}
+	return "file"
+}
+
+// Whether the mime type is an image we can decode (see the imports above)
+func DecodableImageType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(mediaType) {
+	case "image/jpeg", "image/pjpeg", "image/png", "image/gif", "image/bmp", "image/x-ms-bmp", "image/tiff", "image/webp":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// Make a small test image with a bit of everything in it
+func fixtureImage(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestDecodeImageLimited(t *testing.T) {
+	img := fixtureImage(64, 32)
+	fixtures := make(map[string][]byte)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	fixtures["png"] = bytes.Clone(buf.Bytes())
+	buf.Reset()
+	jpeg.Encode(&buf, img, nil)
+	fixtures["jpeg"] = bytes.Clone(buf.Bytes())
+	buf.Reset()
+	gif.Encode(&buf, img, nil)
+	fixtures["gif"] = bytes.Clone(buf.Bytes())
+
+	for format, data := range fixtures {
+		decoded, decodedFormat, err := DecodeImageLimited(bytes.NewReader(data), 64*32)
+		if err != nil {
+			t.Fatalf("Error decoding %s: %s", format, err)
+		}
+		if decodedFormat != format || decoded.Bounds().Dx() != 64 || decoded.Bounds().Dy() != 32 {
+			t.Fatalf("Expected 64x32 %s, got %v %s", format, decoded.Bounds(), decodedFormat)
+		}
+		// One pixel less than the image is too big
+		_, _, err = DecodeImageLimited(bytes.NewReader(data), 64*32-1)
+		var badRequest *BadRequest
+		if !errors.As(err, &badRequest) {
+			t.Fatalf("Expected %s over the pixel limit to be a bad request, got %v", format, err)
+		}
+	}
+
+	// Other files are bad requests, not panics
+	buf.Reset()
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("hello.txt")
+	w.Write([]byte("hello"))
+	zw.Close()
+	for name, data := range map[string][]byte{
+		"zip":       buf.Bytes(),
+		"empty":     {},
+		"text":      []byte("just some text"),
+		"truncated": fixtures["png"][:len(fixtures["png"])/2],
+	} {
+		_, _, err := DecodeImageLimited(bytes.NewReader(data), 1_000_000)
+		var badRequest *BadRequest
+		if !errors.As(err, &badRequest) {
+			t.Fatalf("Expected %s to be a bad request, got %v", name, err)
+		}
+	}
+}
+
+func TestMimeFamily(t *testing.T) {
+	for mimeType, family := range map[string]string{
+		"image/png":                   "image",
+		"audio/mpeg":                  "audio",
+		"video/mp4":                   "video",
+		"text/plain; charset=utf-8":   "text",
+		"application/json":            "text",
+		"application/zip":             "archive",
+		"application/x-7z-compressed": "archive",
+		"application/pdf":             "file",
+		"":                            "file",
+		"garbage":                     "file",
+	} {
+		if result := MimeFamily(mimeType); result != family {
+			t.Fatalf("Expected %q to be %s, got %s", mimeType, family, result)
+		}
+	}
+}
+
+func TestDecodableImageType(t *testing.T) {
+	for mimeType, decodable := range map[string]bool{
+		"image/png":       true,
+		"IMAGE/JPEG":      true,
+		"image/webp; q=1": true,
+		"image/svg+xml":   false,
+		"image/heic":      false,
+		"text/html":       false,
+		"":                false,
+	} {
+		if DecodableImageType(mimeType) != decodable {
+			t.Fatalf("Expected %q decodable to be %t", mimeType, decodable)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+)
+
+// A read-only filesystem made of layers. Files in earlier layers hide the same
+// files in later ones (like ReadConfigStack, but for files), and directories
+// list the files from every layer
+type LayeredFS []fs.FS
+
+func (l LayeredFS) Open(name string) (fs.File, error) {
+	var firstErr error
+	for i, layer := range l {
+		file, err := layer.Open(name)
+		if err != nil {
+			if firstErr == nil && !errors.Is(err, fs.ErrNotExist) {
+				firstErr = err
+			}
+			continue
+		}
+		stat, err := file.Stat()
+		if err != nil || !stat.IsDir() {
+			return file, err
+		}
+		// Directories need their listing merged with the layers below
+		entries, err := l[i:].ReadDir(name)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &layeredDir{File: file, entries: entries}, nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// Merge the directory listings from every layer (sorted by name)
+func (l LayeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	seen := make(map[string]struct{})
+	result := make([]fs.DirEntry, 0)
+	found := false
+	for _, layer := range l {
+		entries, err := fs.ReadDir(layer, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+		for _, e := range entries {
+			if _, ok := seen[e.Name()]; !ok {
+				seen[e.Name()] = struct{}{}
+				result = append(result, e)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	slices.SortFunc(result, func(a fs.DirEntry, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return result, nil
+}
+
+type layeredDir struct {
+	fs.File
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *layeredDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	count = min(count, len(remaining))
+	d.offset += count
+	return remaining[:count], nil
+}
+
+// Add a folder on disk as a layer, but only if it's set and actually exists
+func (l LayeredFS) WithDir(dir string) LayeredFS {
+	if dir == "" {
+		return l
+	}
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return l
+	}
+	return append(l, os.DirFS(dir))
+}
+
+// Hash the paths and contents of every file in the given filesystems. Good for
+// cache busting: it only changes when the files do
+func HashFS(filesystems ...fs.FS) (string, error) {
+	hash := sha1.New()
+	for i, fsys := range filesystems {
+		io.WriteString(hash, fmt.Sprintf("%d\x00", i))
+		err := hashFS(hash, fsys)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12], nil
+}
+
+func hashFS(hash io.Writer, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		file, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		io.WriteString(hash, p+"\x00")
+		_, err = io.Copy(hash, file)
+		return err
+	})
+}
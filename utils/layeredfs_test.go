@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLayeredFS(t *testing.T) {
+	top := fstest.MapFS{
+		"common.css":        {Data: []byte("top")},
+		"templates/a.tmpl":  {Data: []byte("top a")},
+		"templates/new.txt": {Data: []byte("new")},
+	}
+	bottom := fstest.MapFS{
+		"common.css":       {Data: []byte("bottom")},
+		"index.css":        {Data: []byte("bottom index")},
+		"templates/a.tmpl": {Data: []byte("bottom a")},
+		"templates/b.tmpl": {Data: []byte("bottom b")},
+	}
+	layered := LayeredFS{top, bottom}
+
+	for name, expected := range map[string]string{
+		"common.css":       "top",
+		"index.css":        "bottom index",
+		"templates/a.tmpl": "top a",
+		"templates/b.tmpl": "bottom b",
+	} {
+		data, err := fs.ReadFile(layered, name)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", name, err)
+		}
+		if string(data) != expected {
+			t.Fatalf("Expected %s to be %q, got %q", name, expected, data)
+		}
+	}
+
+	if _, err := layered.Open("nothing.css"); err == nil {
+		t.Fatalf("Expected error opening missing file")
+	}
+
+	found, err := fs.Glob(layered, "templates/*.tmpl")
+	if err != nil {
+		t.Fatalf("Error globbing: %s", err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 merged templates, got %v", found)
+	}
+
+	// The standard tests check directory reads, stat, etc all agree
+	err = fstest.TestFS(layered, "common.css", "index.css", "templates/a.tmpl", "templates/b.tmpl", "templates/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashFS(t *testing.T) {
+	a := fstest.MapFS{"a.css": {Data: []byte("a")}}
+	b := fstest.MapFS{"a.css": {Data: []byte("b")}}
+	hashA, err := HashFS(a)
+	if err != nil {
+		t.Fatalf("Error hashing: %s", err)
+	}
+	hashA2, _ := HashFS(a)
+	hashB, _ := HashFS(b)
+	if hashA != hashA2 || hashA == hashB {
+		t.Fatalf("Bad hashes: %s %s %s", hashA, hashA2, hashB)
+	}
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"image"
+	"math/bits"
+
+	"github.com/disintegration/imaging"
+)
+
+// A 64 bit difference hash (dHash) of the image: shrink it to 9x8 grey, then
+// each bit is whether a pixel is brighter than the one to its right. Resized,
+// recompressed or slightly edited copies of an image get (nearly) the same hash
+func DHash(img image.Image) uint64 {
+	small := imaging.Resize(imaging.Grayscale(img), 9, 8, imaging.Lanczos)
+	var hash uint64
+	for y := range 8 {
+		for x := range 8 {
+			hash <<= 1
+			// Grayscale, so any channel will do
+			if small.Pix[small.PixOffset(x, y)] > small.Pix[small.PixOffset(x+1, y)] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// How many bits differ between two hashes (0 is identical, 64 is opposite)
+func HashDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Group the hashes that are within maxDistance of each other (and anything
+// within maxDistance of those, etc). Returns the indexes of each group with
+// more than one member, in the order they were given. This compares every
+// pair, which is fine for the tens of thousands of images we have
+func GroupSimilar(hashes []uint64, maxDistance int) [][]int {
+	// Union find, always pointing at the earliest index
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if HashDistance(hashes[i], hashes[j]) > maxDistance {
+				continue
+			}
+			a, b := find(i), find(j)
+			if a != b {
+				parent[max(a, b)] = min(a, b)
+			}
+		}
+	}
+	members := make(map[int][]int)
+	roots := make([]int, 0)
+	for i := range hashes {
+		root := find(i)
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], i)
+	}
+	groups := make([][]int, 0)
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			groups = append(groups, members[root])
+		}
+	}
+	return groups
+}
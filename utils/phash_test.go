@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// Something photo-ish: a couple of soft blobs on a gradient
+func fixturePhoto(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+			v := 80 * fx
+			if d := (fx-0.3)*(fx-0.3) + (fy-0.4)*(fy-0.4); d < 0.04 {
+				v += 150 * (1 - d/0.04)
+			}
+			if d := (fx-0.7)*(fx-0.7) + (fy-0.7)*(fy-0.7); d < 0.02 {
+				v += 100 * (1 - d/0.02)
+			}
+			img.Set(x, y, color.NRGBA{R: uint8(v), G: uint8(v * 0.8), B: uint8(255 - v), A: 255})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	original := fixturePhoto(400, 300)
+	hash := DHash(original)
+
+	// A smaller, recompressed copy is a near duplicate
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, imaging.Resize(original, 160, 120, imaging.Lanczos), &jpeg.Options{Quality: 60})
+	smaller, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := HashDistance(hash, DHash(smaller)); d > 4 {
+		t.Fatalf("Expected resized copy to be close, distance %d", d)
+	}
+	if d := HashDistance(hash, DHash(imaging.FlipH(original))); d < 20 {
+		t.Fatalf("Expected flipped image to be far, distance %d", d)
+	}
+	if HashDistance(hash, hash) != 0 || HashDistance(0, ^uint64(0)) != 64 {
+		t.Fatalf("Bad distances")
+	}
+}
+
+func TestGroupSimilar(t *testing.T) {
+	hashes := []uint64{
+		0b0000_0000, // 0: group with 2 and (through 2) 4
+		0xFFFF_0000, // 1: alone
+		0b0000_0111, // 2
+		0xFF00_FF00, // 3: with 5
+		0b0011_1111, // 4: too far from 0, but close to 2
+		0xFF00_FF01, // 5
+	}
+	groups := GroupSimilar(hashes, 3)
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %v", groups)
+	}
+	if len(groups[0]) != 3 || groups[0][0] != 0 || groups[0][1] != 2 || groups[0][2] != 4 {
+		t.Fatalf("Bad first group: %v", groups[0])
+	}
+	if len(groups[1]) != 2 || groups[1][0] != 3 || groups[1][1] != 5 {
+		t.Fatalf("Bad second group: %v", groups[1])
+	}
+	if groups := GroupSimilar(hashes, 0); len(groups) != 0 {
+		t.Fatalf("Expected no exact duplicates, got %v", groups)
+	}
+}
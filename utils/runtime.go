@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"runtime/metrics"
 )
 
@@ -47,3 +48,18 @@ func GetRuntimeInfo() RuntimeInfo {
 		HeapGoal:        Uint64SafeMetric(&sample[4]),
 	}
 }
+
+// A byte count for people: 512 B, 1.5 KB, 20.3 MB, etc (1024 based)
+func FormatBytes(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / 1024
+	units := []string{"KB", "MB", "GB", "TB"}
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -29,3 +29,18 @@ func TestGetRuntimeInfo(t *testing.T) {
 		t.Fatalf("Expected some value for TotalAllocBytes (got 0)")
 	}
 }
+
+func TestFormatBytes(t *testing.T) {
+	for size, expected := range map[int64]string{
+		0:                "0 B",
+		1023:             "1023 B",
+		1536:             "1.5 KB",
+		20 * 1024 * 1024: "20.0 MB",
+		3 << 40:          "3.0 TB",
+		2048 * (1 << 40): "2048.0 TB",
+	} {
+		if result := FormatBytes(size); result != expected {
+			t.Fatalf("Expected %d to be %q, got %q", size, expected, result)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Describe how long ago (or how far ahead) the given time is from now in
+// rough human terms, ex: "3 days ago", "in 2 hours"
+func RelativeTime(t time.Time, now time.Time) string {
+	diff := now.Sub(t)
+	future := diff < 0
+	if future {
+		diff = -diff
+	}
+	var amount int64
+	var unit string
+	switch {
+	case diff < time.Minute:
+		return "just now"
+	case diff < time.Hour:
+		amount, unit = int64(diff/time.Minute), "minute"
+	case diff < 24*time.Hour:
+		amount, unit = int64(diff/time.Hour), "hour"
+	case diff < 30*24*time.Hour:
+		amount, unit = int64(diff/(24*time.Hour)), "day"
+	case diff < 365*24*time.Hour:
+		amount, unit = int64(diff/(30*24*time.Hour)), "month"
+	default:
+		amount, unit = int64(diff/(365*24*time.Hour)), "year"
+	}
+	if amount != 1 {
+		unit += "s"
+	}
+	if future {
+		return fmt.Sprintf("in %d %s", amount, unit)
+	}
+	return fmt.Sprintf("%d %s ago", amount, unit)
+}
+
+// Formats people (and browser date/datetime-local inputs) type dates in
+var userTimeLayouts = []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02 15:04:05"}
+
+// Parse a date or datetime given by a user. Anything without a zone is taken
+// to be in the given location. Also returns whether it was just a date (no time)
+func ParseUserTime(value string, loc *time.Location) (time.Time, bool, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, false, nil
+	}
+	for i, layout := range userTimeLayouts {
+		if parsed, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return parsed, i == 0, nil
+		}
+	}
+	return time.Time{}, false, &BadRequest{Message: fmt.Sprintf("Can't understand date %q, use YYYY-MM-DD or YYYY-MM-DDTHH:MM", value)}
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[time.Duration]string{
+		10 * time.Second:         "just now",
+		-10 * time.Second:        "just now",
+		time.Minute:              "1 minute ago",
+		90 * time.Minute:         "1 hour ago",
+		3 * 24 * time.Hour:       "3 days ago",
+		-2 * time.Hour:           "in 2 hours",
+		65 * 24 * time.Hour:      "2 months ago",
+		3 * 365 * 24 * time.Hour: "3 years ago",
+	}
+	for ago, expected := range tests {
+		if relative := RelativeTime(now.Add(-ago), now); relative != expected {
+			t.Fatalf("Expected %s before now to be %q, got %q", ago, expected, relative)
+		}
+	}
+}
+
+func TestParseUserTime(t *testing.T) {
+	loc := time.FixedZone("test", -5*60*60)
+	tests := map[string]time.Time{
+		"2024-06-01":                time.Date(2024, 6, 1, 5, 0, 0, 0, time.UTC),
+		"2024-06-01T13:30":          time.Date(2024, 6, 1, 18, 30, 0, 0, time.UTC),
+		"2024-06-01 13:30:15":       time.Date(2024, 6, 1, 18, 30, 15, 0, time.UTC),
+		"2024-06-01T13:30:00+01:00": time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+	for value, expected := range tests {
+		parsed, _, err := ParseUserTime(value, loc)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", value, err)
+		}
+		if !parsed.Equal(expected) {
+			t.Fatalf("Expected %s to be %s, got %s", value, expected, parsed.UTC())
+		}
+	}
+	if _, dateOnly, _ := ParseUserTime("2024-06-01", loc); !dateOnly {
+		t.Fatalf("Expected plain date to be date only")
+	}
+	if _, _, err := ParseUserTime("yesterday", loc); err == nil {
+		t.Fatalf("Expected error for bad date")
+	}
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	WarcVersion         = "WARC/1.1"
+	WarcDateFormat      = "2006-01-02T15:04:05Z"
+	CdxTimestampFormat  = "20060102150405"
+	CdxHeader           = " CDX N b a m s k r M S V g"
+	WarcRequestContent  = "application/http;msgtype=request"
+	WarcResponseContent = "application/http;msgtype=response"
+)
+
+// Where a single record ended up in the compressed file. This is what the
+// cdx index needs
+type WarcRecordInfo struct {
+	Id     string
+	Offset int64
+	Length int64
+}
+
+// Write WARC records, each compressed as its own gzip member (which is what
+// makes a .warc.gz seekable with a cdx index)
+type WarcWriter struct {
+	out    io.Writer
+	offset int64
+}
+
+func NewWarcWriter(out io.Writer) *WarcWriter {
+	return &WarcWriter{out: out}
+}
+
+// Compute a digest in the format WARC expects (sha1, base32)
+func WarcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// Create a new record id
+func NewWarcRecordId() string {
+	return fmt.Sprintf("<urn:uuid:%s>", uuid.NewString())
+}
+
+// Write a single record with the given type, headers and block. WARC-Type,
+// WARC-Record-ID, WARC-Date, Content-Length and WARC-Block-Digest are
+// filled in for you (though the record id and date can be overridden)
+func (w *WarcWriter) WriteRecord(warcType string, headers [][2]string, block []byte) (WarcRecordInfo, error) {
+	info := WarcRecordInfo{Offset: w.offset}
+	var record bytes.Buffer
+	record.WriteString(WarcVersion + "\r\n")
+	record.WriteString("WARC-Type: " + warcType + "\r\n")
+	hasDate := false
+	for _, h := range headers {
+		switch h[0] {
+		case "WARC-Record-ID":
+			info.Id = h[1]
+		case "WARC-Date":
+			hasDate = true
+		}
+	}
+	if info.Id == "" {
+		info.Id = NewWarcRecordId()
+		record.WriteString("WARC-Record-ID: " + info.Id + "\r\n")
+	}
+	if !hasDate {
+		record.WriteString("WARC-Date: " + time.Now().UTC().Format(WarcDateFormat) + "\r\n")
+	}
+	for _, h := range headers {
+		record.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	record.WriteString("WARC-Block-Digest: " + WarcDigest(block) + "\r\n")
+	record.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(block)))
+	record.Write(block)
+	record.WriteString("\r\n\r\n")
+
+	counter := &countingWriter{w: w.out}
+	gz := gzip.NewWriter(counter)
+	_, err := gz.Write(record.Bytes())
+	if err != nil {
+		return info, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return info, err
+	}
+	info.Length = counter.count
+	w.offset += counter.count
+	return info, nil
+}
+
+// Write the warcinfo record that should start every file
+func (w *WarcWriter) WriteInfo(filename string, fields map[string]string) (WarcRecordInfo, error) {
+	var block bytes.Buffer
+	for k, v := range fields {
+		block.WriteString(k + ": " + v + "\r\n")
+	}
+	return w.WriteRecord("warcinfo", [][2]string{
+		{"WARC-Filename", filename},
+		{"Content-Type", "application/warc-fields"},
+	}, block.Bytes())
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Produce the sort-friendly url key (SURT) used in cdx files. This is a simple
+// version: host parts reversed, www dropped, everything lowercase
+func SurtUrl(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return strings.ToLower(rawurl)
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	parts := strings.Split(host, ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	key := strings.Join(parts, ",")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		key += ":" + port
+	}
+	key += ")" + strings.ToLower(u.EscapedPath())
+	if u.RawQuery != "" {
+		key += "?" + strings.ToLower(u.RawQuery)
+	}
+	return key
+}
+
+// A single line in a cdx index (the classic 11 field format)
+type CdxLine struct {
+	Url      string
+	Date     time.Time
+	Mime     string
+	Status   int
+	Digest   string
+	Offset   int64
+	Length   int64
+	Filename string
+}
+
+func (c *CdxLine) String() string {
+	mime := c.Mime
+	if mime == "" {
+		mime = "-"
+	}
+	// Cdx digests don't have the algorithm prefix
+	digest := strings.TrimPrefix(c.Digest, "sha1:")
+	return fmt.Sprintf("%s %s %s %s %d %s - - %d %d %s",
+		SurtUrl(c.Url), c.Date.UTC().Format(CdxTimestampFormat), c.Url,
+		strings.ReplaceAll(mime, " ", ""), c.Status, digest, c.Length, c.Offset, c.Filename)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarcWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWarcWriter(&out)
+	info, err := w.WriteInfo("test.warc.gz", map[string]string{"software": "test"})
+	if err != nil {
+		t.Fatalf("Error writing info: %s", err)
+	}
+	if info.Offset != 0 || info.Length != int64(out.Len()) {
+		t.Fatalf("Bad info record position: %v (file is %d)", info, out.Len())
+	}
+	block := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi")
+	resp, err := w.WriteRecord("response", [][2]string{{"WARC-Target-URI", "http://localhost/pages"}}, block)
+	if err != nil {
+		t.Fatalf("Error writing response: %s", err)
+	}
+	if resp.Offset != info.Length || resp.Offset+resp.Length != int64(out.Len()) {
+		t.Fatalf("Bad response record position: %v (file is %d)", resp, out.Len())
+	}
+
+	// Each record must be its own gzip member, readable from its offset
+	reader, err := gzip.NewReader(bytes.NewReader(out.Bytes()[resp.Offset:]))
+	if err != nil {
+		t.Fatalf("Couldn't open response member: %s", err)
+	}
+	reader.Multistream(false)
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Couldn't read response member: %s", err)
+	}
+	record := string(raw)
+	if !strings.HasPrefix(record, "WARC/1.1\r\nWARC-Type: response\r\n") {
+		t.Fatalf("Bad record start: %q", record)
+	}
+	for _, expected := range []string{"WARC-Record-ID: " + resp.Id, "Content-Length: 40\r\n", "WARC-Target-URI: http://localhost/pages"} {
+		if !strings.Contains(record, expected) {
+			t.Fatalf("Expected record to contain %q: %q", expected, record)
+		}
+	}
+	if !strings.HasSuffix(record, "\r\n\r\nhi\r\n\r\n") {
+		t.Fatalf("Bad record end: %q", record)
+	}
+}
+
+func TestSurtUrl(t *testing.T) {
+	tests := map[string]string{
+		"http://www.Example.com/Pages/chat?page=1": "com,example)/pages/chat?page=1",
+		"http://localhost:5030/pages":              "localhost:5030)/pages",
+		"https://a.b.example.org/":                 "org,example,b,a)/",
+	}
+	for in, expected := range tests {
+		if surt := SurtUrl(in); surt != expected {
+			t.Fatalf("Expected SURT of %s to be %s, got %s", in, expected, surt)
+		}
+	}
+}
+
+func TestCdxLine(t *testing.T) {
+	line := CdxLine{
+		Url:      "http://localhost/pages",
+		Date:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Mime:     "text/html; charset=utf-8",
+		Status:   200,
+		Digest:   "sha1:ABC",
+		Offset:   10,
+		Length:   20,
+		Filename: "site.warc.gz",
+	}
+	expected := "localhost)/pages 20240102030405 http://localhost/pages text/html;charset=utf-8 200 ABC - - 20 10 site.warc.gz"
+	if line.String() != expected {
+		t.Fatalf("Expected cdx line\n%s\ngot\n%s", expected, line.String())
+	}
+}
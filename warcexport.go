@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/randomouscrap98/gontentapi/contentapi"
+	"github.com/randomouscrap98/gontentapi/utils"
+)
+
+type WarcOptions struct {
+	Base  string   // Scheme and host the urls in the archive should use
+	Types []string // Content type prefixes to write to the archive (empty means all)
+	Start string   // Only follow pages created on or after this (compared as a string)
+	End   string   // Only follow pages created before this (compared as a string)
+}
+
+// Crawls the gontentapi handlers in-process (no network) and writes everything
+// it finds into a WARC file
+type WarcCrawler struct {
+	gctx      *GonContext
+	handler   http.Handler
+	options   *WarcOptions
+	writer    *utils.WarcWriter
+	filename  string
+	linkRegex *regexp.Regexp
+	allowed   map[string]struct{} // Hashes of content viewable and within the date range
+	seen      map[string]struct{}
+	queue     []string
+	cdx       []utils.CdxLine
+}
+
+func NewWarcCrawler(gctx *GonContext, out io.Writer, filename string, options *WarcOptions) (*WarcCrawler, error) {
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+	err := SetupRoutes(r, gctx)
+	if err != nil {
+		return nil, err
+	}
+	linkRegex, err := regexp.Compile(`(href|src|srcset)="([^"]*)"`)
+	if err != nil {
+		return nil, err
+	}
+	return &WarcCrawler{
+		gctx:      gctx,
+		handler:   r,
+		options:   options,
+		writer:    utils.NewWarcWriter(out),
+		filename:  filename,
+		linkRegex: linkRegex,
+		seen:      make(map[string]struct{}),
+		queue:     make([]string, 0),
+		cdx:       make([]utils.CdxLine, 0),
+	}, nil
+}
+
+// Lookup all the content the crawl is allowed to follow (anonymously viewable
+// and within the date range)
+func (c *WarcCrawler) loadAllowed() error {
+	q := contentapi.NewQuery()
+	q.Sql = "SELECT c.hash FROM content c WHERE 1"
+	if c.options.Start != "" {
+		q.AndTimeAtLeast("c.createDate", contentapi.NormalizeDbTime(c.options.Start))
+	}
+	if c.options.End != "" {
+		q.AndTimeBefore("c.createDate", contentapi.NormalizeDbTime(c.options.End))
+	}
+	q.AndViewable("c.id", 0)
+	q.Finalize()
+
+	hashes := make([]string, 0)
+	err := c.gctx.contentdb.Select(&hashes, q.Sql, q.Params...)
+	if err != nil {
+		return err
+	}
+	c.allowed = make(map[string]struct{}, len(hashes))
+	for _, h := range hashes {
+		c.allowed[h] = struct{}{}
+	}
+	return nil
+}
+
+// Whether the crawl should follow the given (root relative) url
+func (c *WarcCrawler) ShouldFollow(u *url.URL) bool {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	_, allowed := c.allowed[parts[len(parts)-1]]
+	switch {
+	case u.Path == "/pages":
+		return true
+	case parts[0] == "pages" && len(parts) == 2:
+		return allowed
+	case parts[0] == "comments" && len(parts) == 2:
+		// Only comment paging, not searches
+		query := u.Query()
+		query.Del("page")
+		query.Del("iframe")
+		return allowed && len(query) == 0
+	case parts[0] == "uploads" && len(parts) == 2, parts[0] == "thumbnails" && len(parts) == 2, parts[0] == "avatars" && len(parts) == 2:
+		return true
+	case (parts[0] == "static" || parts[0] == "themes") && len(parts) > 1:
+		return true
+	}
+	return false
+}
+
+// Queue every followable link in the given html
+func (c *WarcCrawler) QueueLinks(page []byte, current *url.URL) {
+	root := c.gctx.Config().RootPath
+	for _, groups := range c.linkRegex.FindAllSubmatch(page, -1) {
+		value := html.UnescapeString(string(groups[2]))
+		links := []string{value}
+		if string(groups[1]) == "srcset" {
+			// A list of "url 2x" candidates, we want every url
+			links = links[:0]
+			for _, candidate := range strings.Split(value, ",") {
+				if fields := strings.Fields(candidate); len(fields) > 0 {
+					links = append(links, fields[0])
+				}
+			}
+		}
+		for _, link := range links {
+			if strings.HasPrefix(link, "?") {
+				link = current.Path + link
+			} else if strings.HasPrefix(link, root+"/") {
+				link = strings.TrimPrefix(link, root)
+			} else {
+				continue
+			}
+			target, err := url.Parse(link)
+			if err != nil {
+				continue
+			}
+			target.Fragment = ""
+			if c.ShouldFollow(target) {
+				c.Queue(target.String())
+			}
+		}
+	}
+}
+
+func (c *WarcCrawler) Queue(link string) {
+	if _, ok := c.seen[link]; ok {
+		return
+	}
+	c.seen[link] = struct{}{}
+	c.queue = append(c.queue, link)
+}
+
+// Whether responses of the given type should be written to the archive
+func (c *WarcCrawler) WantType(contentType string) bool {
+	if len(c.options.Types) == 0 {
+		return true
+	}
+	for _, t := range c.options.Types {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch a single url, write the request/response pair, and queue its links
+func (c *WarcCrawler) Crawl(link string) error {
+	req := httptest.NewRequest("GET", link, nil)
+	rec := httptest.NewRecorder()
+	date := time.Now().UTC()
+	c.handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	body := rec.Body.Bytes()
+	contentType := resp.Header.Get("Content-Type")
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("WARN: %s returned %d", link, resp.StatusCode)
+	}
+
+	if strings.HasPrefix(contentType, "text/html") {
+		c.QueueLinks(body, req.URL)
+	}
+
+	if !c.WantType(contentType) {
+		return nil
+	}
+
+	// The urls in the archive should look like where the site is actually hosted
+	targetUri := c.options.Base + c.gctx.Config().RootPath + link
+	var err error
+	req.URL, err = url.Parse(targetUri)
+	if err != nil {
+		return err
+	}
+	req.Host = req.URL.Host
+	req.RequestURI = ""
+
+	var reqBlock bytes.Buffer
+	err = req.Write(&reqBlock)
+	if err != nil {
+		return err
+	}
+
+	var respBlock bytes.Buffer
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	err = resp.Write(&respBlock)
+	if err != nil {
+		return err
+	}
+
+	responseId := utils.NewWarcRecordId()
+	warcDate := date.Format(utils.WarcDateFormat)
+	payloadDigest := utils.WarcDigest(body)
+	info, err := c.writer.WriteRecord("response", [][2]string{
+		{"WARC-Record-ID", responseId},
+		{"WARC-Date", warcDate},
+		{"WARC-Target-URI", targetUri},
+		{"WARC-Payload-Digest", payloadDigest},
+		{"Content-Type", utils.WarcResponseContent},
+	}, respBlock.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = c.writer.WriteRecord("request", [][2]string{
+		{"WARC-Date", warcDate},
+		{"WARC-Target-URI", targetUri},
+		{"WARC-Concurrent-To", responseId},
+		{"Content-Type", utils.WarcRequestContent},
+	}, reqBlock.Bytes())
+	if err != nil {
+		return err
+	}
+
+	c.cdx = append(c.cdx, utils.CdxLine{
+		Url:      targetUri,
+		Date:     date,
+		Mime:     contentType,
+		Status:   resp.StatusCode,
+		Digest:   payloadDigest,
+		Offset:   info.Offset,
+		Length:   info.Length,
+		Filename: c.filename,
+	})
+
+	return nil
+}
+
+// Crawl everything reachable from /pages (and the allowed content)
+func (c *WarcCrawler) Run() error {
+	err := c.loadAllowed()
+	if err != nil {
+		return err
+	}
+	_, err = c.writer.WriteInfo(c.filename, map[string]string{
+		"software":    "gontentapi/" + Version,
+		"format":      "WARC File Format 1.1",
+		"description": "In-process crawl of a gontentapi instance",
+	})
+	if err != nil {
+		return err
+	}
+	// Files aren't linked as subpages, so start with everything we're allowed
+	// to see. The links found along the way fill in the rest
+	c.Queue("/pages")
+	hashes := make([]string, 0, len(c.allowed))
+	for hash := range c.allowed {
+		hashes = append(hashes, hash)
+	}
+	slices.Sort(hashes)
+	for _, hash := range hashes {
+		c.Queue("/pages/" + url.PathEscape(hash))
+	}
+	for i := 0; i < len(c.queue); i++ {
+		err = c.Crawl(c.queue[i])
+		if err != nil {
+			return err
+		}
+		if (i+1)%100 == 0 {
+			log.Printf("Crawled %d/%d urls", i+1, len(c.queue))
+		}
+	}
+	log.Printf("Crawled %d urls, archived %d", len(c.queue), len(c.cdx))
+	return nil
+}
+
+// Write the cdx index for everything archived. The lines must be sorted
+func (c *WarcCrawler) WriteCdx(out io.Writer) error {
+	lines := make([]string, len(c.cdx))
+	for i := range c.cdx {
+		lines[i] = c.cdx[i].String()
+	}
+	slices.Sort(lines)
+	writer := bufio.NewWriter(out)
+	_, err := fmt.Fprintln(writer, utils.CdxHeader)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		_, err = fmt.Fprintln(writer, l)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// The warc command: crawl the site into a WARC file and cdx index
+func runWarc(cli *Cli, args []string) error {
+	flags := flag.NewFlagSet("warc", flag.ContinueOnError)
+	output := flags.String("out", "site.warc.gz", "WARC file to write (the cdx goes next to it)")
+	base := flags.String("base", "http://localhost", "Scheme and host for the archived urls")
+	types := flags.String("types", "", "Comma separated content type prefixes to archive, ex: text/html,image/ (default all)")
+	start := flags.String("start", "", "Only crawl content created on or after this date")
+	end := flags.String("end", "", "Only crawl content created before this date")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	options := WarcOptions{
+		Base:  strings.TrimRight(*base, "/"),
+		Start: *start,
+		End:   *end,
+	}
+	if *types != "" {
+		options.Types = strings.Split(*types, ",")
+	}
+
+	_, gctx, err := cli.LoadContext()
+	if err != nil {
+		return err
+	}
+
+	warcfile, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer warcfile.Close()
+
+	crawler, err := NewWarcCrawler(gctx, warcfile, filepath.Base(*output), &options)
+	if err != nil {
+		return err
+	}
+	err = crawler.Run()
+	if err != nil {
+		return err
+	}
+
+	cdxPath := strings.TrimSuffix(strings.TrimSuffix(*output, ".gz"), ".warc") + ".cdx"
+	cdxfile, err := os.Create(cdxPath)
+	if err != nil {
+		return err
+	}
+	defer cdxfile.Close()
+	err = crawler.WriteCdx(cdxfile)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %s and %s", *output, cdxPath)
+	return nil
+}